@@ -2,21 +2,56 @@ package client
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
 	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/batch"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/congestion"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/flow"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/fragment"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pipe"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pmtu"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/queue"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/registry"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/reliable"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/secure"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
 )
 
 var (
-	ErrCannotConnect error = errors.New("cannot connect to controller")
+	ErrCannotConnect    error = errors.New("cannot connect to controller")
+	ErrHandshakeTimeout error = errors.New("controller not responded auth")
+	ErrInvalidTransport error = errors.New("invalid transport, use auto, udp, tcp or tls")
+	ErrClosed           error = errors.New("client closed")
+	ErrUnauthorized     error = &proto.Error{Code: proto.CodeUnauthorized, Message: "controller rejected agent token"} // Match any unauthorized error from controller
+	ErrNotListening     error = errors.New("controller cannot listen tunnel ports")
+	ErrIncompatible     error = errors.New("controller not support agent protocol version")
+	ErrNoRequestID      error = errors.New("controller not support request IDs")
+
+	Version          string        = "devel"                // Agent version sent to controller in hello
+	HandshakeTimeout time.Duration = time.Second * 5        // Time to wait auth response
+	HandshakeRetries int           = 3                      // Auth requests sent over UDP before fallback
+	CallResend       time.Duration = time.Second            // Resend call request if controller not respond
+	FlushTimeout     time.Duration = time.Second * 10       // Time to controller acknowledge client data before close client
+	PingInterval     time.Duration = time.Second * 3        // Interval to send ping to controller
+	PongTimeout      time.Duration = time.Second * 15       // Reconnect if controller not respond in this time
+	ReconnectMin     time.Duration = time.Second            // First reconnect delay
+	ReconnectMax     time.Duration = time.Second * 30       // Max reconnect delay after exponential backoff
+	PipeBuffer       int           = 0x40000                // Bytes buffered to each local connection before wait read, UDP datagrams are dropped if full
+	StreamWindow     uint64        = proto.InitialWindow    // Bytes controller can send to TCP client before agent write to client
+	Congestion       string        = congestion.NameNewReno // Congestion controller to TCP client streams, newreno or bbr
 )
 
 type NewClient struct {
@@ -24,24 +59,68 @@ type NewClient struct {
 	Writer net.Conn
 }
 
+type ClientConfig struct {
+	Transport string          // proto.TransportAuto, proto.TransportUDP, proto.TransportTCP or proto.TransportTLS
+	TLSConfig *tls.Config     // Config to TLS transport
+	ServerKey *ecdh.PublicKey // Controller static key pinned, if set connection is encrypted
+}
+
 type Client struct {
 	Token        [36]byte
 	RemoteAdress []netip.AddrPort
-	clientsTCP   map[string]net.Conn
-	clientsUDP   map[string]net.Conn
+	Config       ClientConfig
+	clientsTCP   *registry.Registry[string, net.Conn]
+	clientsUDP   *registry.Registry[string, net.Conn]
+	tcpStreams   *registry.Registry[string, *reliable.Stream] // Sequence and retransmit TCP clients data
+	sendWindows  *registry.Registry[string, *flow.Send]       // Credit to send data to TCP clients
+	recvWindows  *registry.Registry[string, *flow.Recv]       // Data consumed from TCP clients
+	halfClosed   *registry.Registry[string, bool]             // TCP clients with one direction closed
 	NewClient    chan NewClient
 
-	Conn      *net.UDPConn
+	Conn      net.Conn          // Controller connection
+	reader    proto.FrameReader // Buffered reader from Conn
 	AgentInfo *proto.AgentInfo
+	Hello     *proto.Hello // Controller version and capabilities negotiated
+
+	connMu   sync.RWMutex // Guard Conn swap on reconnect
+	online   atomic.Bool  // Connected and authenticated
+	lastPong atomic.Int64 // Last response from controller in unix milliseconds
+	err      error        // Error to stop reconnect
+
+	datagram  atomic.Uint32         // Datagram size to controller connection, updated by path MTU discovery
+	prober    *pmtu.Prober          // Path MTU probes waiting echo
+	fragID    atomic.Uint32         // Last fragment ID sent
+	fragments *fragment.Reassembler // Fragments from controller waiting reassembly
+
+	requestID atomic.Uint32                                    // Last request ID
+	pending   *registry.Registry[uint32, chan *proto.Response] // Calls waiting response
+
+	closeOnce sync.Once
+	closing   chan struct{} // Closed when shutdown started
 }
 
+// Create client and connect with UDP, fallback to TCP if UDP not respond
 func CreateClient(Addres []netip.AddrPort, Token [36]byte) (*Client, error) {
+	return CreateClientConfig(Addres, Token, ClientConfig{Transport: proto.TransportAuto})
+}
+
+// Create client and connect to controller with transport and encryption from config
+func CreateClientConfig(Addres []netip.AddrPort, Token [36]byte, Config ClientConfig) (*Client, error) {
 	cli := &Client{
 		Token:        Token,
 		RemoteAdress: Addres,
-		clientsTCP:   make(map[string]net.Conn),
-		clientsUDP:   make(map[string]net.Conn),
+		Config:       Config,
+		clientsTCP:   registry.New[string, net.Conn](),
+		clientsUDP:   registry.New[string, net.Conn](),
+		tcpStreams:   registry.New[string, *reliable.Stream](),
+		sendWindows:  registry.New[string, *flow.Send](),
+		recvWindows:  registry.New[string, *flow.Recv](),
+		halfClosed:   registry.New[string, bool](),
 		NewClient:    make(chan NewClient),
+		prober:       pmtu.NewProber(),
+		fragments:    fragment.NewReassembler(),
+		pending:      registry.New[uint32, chan *proto.Response](),
+		closing:      make(chan struct{}),
 	}
 	if err := cli.Setup(); err != nil {
 		return cli, err
@@ -50,172 +129,820 @@ func CreateClient(Addres []netip.AddrPort, Token [36]byte) (*Client, error) {
 }
 
 func (client *Client) Send(req proto.Request) error {
-	return proto.WriteRequest(client.Conn, req)
+	return proto.WriteRequest(client.conn(), req)
 }
 
-func (client *Client) Setup() error {
-	for _, addr := range client.RemoteAdress {
-		var err error
-		if client.Conn, err = net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addr)); err != nil {
-			continue
+// Next request ID, zero is reserved to requests without response
+func (client *Client) nextID() uint32 {
+	for {
+		if id := client.requestID.Add(1); id != 0 {
+			return id
 		}
-		client.Conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-		var auth = proto.AgentAuth(client.Token)
-		for {
-			client.Send(proto.Request{AgentAuth: &auth})
+	}
+}
 
-			buff := make([]byte, 1024)
-			n, err := client.Conn.Read(buff)
-			if err != nil {
-				return err
+// Send control request and wait response with same ID, request is resent each CallResend until ctx is done.
+// Controller error is returned with response
+func (client *Client) Call(ctx context.Context, req proto.Request) (*proto.Response, error) {
+	if client.version() < proto.VersionRequestID {
+		return nil, ErrNoRequestID
+	}
+	req.ID = client.nextID()
+	wait := make(chan *proto.Response, 1)
+	client.pending.Store(req.ID, wait)
+	defer client.pending.Delete(req.ID)
+	for {
+		if err := client.Send(req); err != nil {
+			return nil, err
+		}
+		select {
+		case res := <-wait:
+			if res.Error != nil {
+				return res, res.Error
 			}
+			return res, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(CallResend):
+		}
+	}
+}
+
+// Protocol version negotiated with controller
+func (client *Client) version() uint16 {
+	client.connMu.RLock()
+	defer client.connMu.RUnlock()
+	if client.Hello == nil {
+		return proto.ProtocolVersion
+	}
+	return client.Hello.Version
+}
+
+// Tunnel info from last auth, replaced on reconnect
+func (client *Client) Info() *proto.AgentInfo {
+	client.connMu.RLock()
+	defer client.connMu.RUnlock()
+	return client.AgentInfo
+}
+
+// Controller version and capabilities negotiated in last connect
+func (client *Client) ControllerHello() *proto.Hello {
+	client.connMu.RLock()
+	defer client.connMu.RUnlock()
+	return client.Hello
+}
+
+func (client *Client) conn() net.Conn {
+	client.connMu.RLock()
+	defer client.connMu.RUnlock()
+	return client.Conn
+}
+
+// Error stopped agent, NewClient is closed after agent stop
+func (client *Client) Err() error {
+	return client.err
+}
+
+func (client *Client) transports() ([]string, error) {
+	switch client.Config.Transport {
+	case "", proto.TransportAuto:
+		return []string{proto.TransportUDP, proto.TransportTCP}, nil
+	case proto.TransportUDP, proto.TransportTCP, proto.TransportTLS:
+		return []string{client.Config.Transport}, nil
+	}
+	return nil, ErrInvalidTransport
+}
 
-			res, err := proto.ReaderResponse(bytes.NewBuffer(buff[:n]))
+func (client *Client) dial(transport string, addr netip.AddrPort) (net.Conn, error) {
+	switch transport {
+	case proto.TransportUDP:
+		conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			return nil, err
+		} else if err = pmtu.SetDontFragment(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return batch.NewConn(conn), nil // Read and write many datagrams per syscall
+	case proto.TransportTCP:
+		return net.DialTimeout("tcp", addr.String(), HandshakeTimeout)
+	case proto.TransportTLS:
+		return tls.DialWithDialer(&net.Dialer{Timeout: HandshakeTimeout}, "tcp", addr.String(), client.Config.TLSConfig)
+	}
+	return nil, ErrInvalidTransport
+}
+
+// Connect to controller and process requests, agent reconnect if connection is lost
+func (client *Client) Setup() error {
+	if err := client.connect(); err != nil {
+		return err
+	}
+	client.online.Store(true)
+	go client.handlers()
+	go client.pinger()
+	go client.discoverMTU(client.conn())
+	return nil
+}
+
+// Try all addresses and transports, resume session if agent is connected before
+func (client *Client) connect() error {
+	transports, err := client.transports()
+	if err != nil {
+		return err
+	}
+	for _, addr := range client.RemoteAdress {
+		for _, transport := range transports {
+			conn, err := client.dial(transport, addr)
 			if err != nil {
-				if opt, isOpt := err.(*net.OpError); isOpt {
-					if opt.Timeout() {
-						<-time.After(time.Second * 3)
-						client.Send(proto.Request{AgentAuth: &auth})
-						continue
+				continue
+			} else if client.Config.ServerKey != nil {
+				secureConn, err := secure.Client(conn, client.Config.ServerKey, HandshakeTimeout, client.attempts(transport))
+				if err != nil {
+					conn.Close()
+					if err == secure.ErrServerKey {
+						return err // Controller is not pinned key
 					}
+					continue
+				}
+				conn = secureConn
+			}
+			reader := client.frameReader(conn)
+			hello, err := client.hello(conn, reader, transport)
+			if err != nil {
+				conn.Close()
+				if errors.Is(err, ErrIncompatible) {
+					return err // Controller not support agent, other transports return same
 				}
-				// return err
-				break
-			} else if res.Unauthorized {
-				return ErrCannotConnect
-			} else if res.AgentInfo == nil {
 				continue
 			}
-			client.AgentInfo = res.AgentInfo
-			client.Conn.SetReadDeadline(*new(time.Time)) // clear timeout
-			go client.handlers()
+			info, err := client.auth(conn, reader, transport, hello)
+			if err != nil {
+				conn.Close()
+				if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrNotListening) {
+					return err // Token or tunnel rejected, other transports return same
+				}
+				continue
+			}
+			if client.AgentInfo != nil && client.AgentInfo.SessionID != info.SessionID {
+				client.dropClients() // Controller closed old session
+			}
+			client.connMu.Lock()
+			client.Conn, client.reader, client.AgentInfo, client.Hello = conn, reader, info, hello
+			client.datagram.Store(uint32(pmtu.Initial(conn)))
+			client.connMu.Unlock()
+			client.lastPong.Store(time.Now().UnixMilli())
 			return nil
 		}
 	}
 	return ErrCannotConnect
 }
 
-type toWr struct {
-	Proto uint8
-	To    netip.AddrPort
-	tun   *Client
-}
-
-func (t toWr) Write(w []byte) (int, error) {
-	err := t.tun.Send(proto.Request{
-		DataTX: &proto.ClientData{
-			Client: proto.Client{
-				Client: t.To,
-				Proto:  t.Proto,
-			},
-			Size: uint64(len(w)),
-			Data: w[:],
-		},
+// Requests sent before fallback, stream transports not lost requests
+func (client *Client) attempts(transport string) int {
+	if transport == proto.TransportUDP {
+		return HandshakeRetries
+	}
+	return 1
+}
+
+// Send request and process responses to request with wait until wait return true, UDP resend request on timeout.
+// Resends use same req.ID, late response is accepted
+func (client *Client) exchange(conn net.Conn, reader proto.FrameReader, transport string, req proto.Request, wait func(res *proto.Response) (bool, error)) error {
+	defer conn.SetReadDeadline(time.Time{}) // clear timeout
+	for attempt := 0; attempt < client.attempts(transport); attempt++ {
+		if err := proto.WriteRequest(conn, req); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+		for {
+			res, err := proto.ReaderResponse(reader)
+			if err != nil {
+				if opt, isOpt := err.(net.Error); isOpt && opt.Timeout() {
+					break
+				} else if skipFrame(conn, reader, err) {
+					continue
+				}
+				return err
+			} else if res.ID != req.ID {
+				continue // Response to old request
+			} else if done, err := wait(res); done || err != nil {
+				return err
+			}
+		}
+	}
+	return ErrHandshakeTimeout
+}
+
+// Frame reader to controller connection, UDP frames not continue in next datagram
+func (client *Client) frameReader(conn net.Conn) proto.FrameReader {
+	if pmtu.IsDatagram(conn) {
+		return proto.NewDatagramReader(conn)
+	}
+	return bufio.NewReaderSize(conn, proto.FrameHeaderSize+int(proto.MaxFrameSize))
+}
+
+// Frame error not break stream, or datagram with invalid frame dropped
+func skipFrame(conn net.Conn, reader proto.FrameReader, err error) bool {
+	if proto.IsFrameSkippable(err) {
+		return true
+	} else if pmtu.IsDatagram(conn) && (errors.Is(err, proto.ErrFrameMagic) || errors.Is(err, proto.ErrFrameTruncated) || errors.Is(err, proto.ErrFrameOversized)) {
+		reader.Reset(conn) // Drop rest of datagram, next datagram start with new frame
+		return true
+	}
+	return false
+}
+
+// Agent version and capabilities
+func (client *Client) localHello() *proto.Hello {
+	capabilities := proto.CapMappings | proto.CapResume | proto.CapFlowControl | proto.CapPathMTU | proto.CapNewClient
+	if client.Config.ServerKey != nil {
+		capabilities |= proto.CapEncryption
+	}
+	return &proto.Hello{
+		Version:      proto.ProtocolVersion,
+		MinVersion:   proto.MinProtocolVersion,
+		Capabilities: capabilities,
+		Software:     Version,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+	}
+}
+
+// Send agent hello and wait controller version and capabilities negotiated,
+// hello not have request ID so controllers before request IDs reply incompatible
+func (client *Client) hello(conn net.Conn, reader proto.FrameReader, transport string) (hello *proto.Hello, err error) {
+	err = client.exchange(conn, reader, transport, proto.Request{Hello: client.localHello()}, func(res *proto.Response) (bool, error) {
+		if res.Incompatible != nil {
+			return true, fmt.Errorf("%w: %s", ErrIncompatible, res.Incompatible.Message)
+		}
+		hello = res.Hello
+		return hello != nil, nil
+	})
+	return
+}
+
+// Send token or session to resume and wait agent info
+func (client *Client) auth(conn net.Conn, reader proto.FrameReader, transport string, hello *proto.Hello) (info *proto.AgentInfo, err error) {
+	var req proto.Request
+	if client.AgentInfo != nil && hello.Has(proto.CapResume) {
+		req.Resume = &proto.AgentResume{Token: proto.AgentAuth(client.Token), Session: client.AgentInfo.SessionID}
+	} else {
+		var auth = proto.AgentAuth(client.Token)
+		req.AgentAuth = &auth
+	}
+	if hello.Version >= proto.VersionRequestID {
+		req.ID = client.nextID()
+	}
+	err = client.exchange(conn, reader, transport, req, func(res *proto.Response) (bool, error) {
+		if res.Error != nil && res.Error.IsListen() {
+			return true, fmt.Errorf("%w: %w", ErrNotListening, res.Error)
+		} else if res.Error != nil {
+			return true, res.Error // Unauthorized or controller cannot auth now
+		} else if res.Incompatible != nil {
+			return true, fmt.Errorf("%w: %s", ErrIncompatible, res.Incompatible.Message)
+		}
+		info = res.AgentInfo
+		return info != nil, nil
+	})
+	return
+}
+
+// Close local clients from old session
+func (client *Client) dropClients() {
+	for _, stream := range client.tcpStreams.Drain() {
+		stream.Close()
+	}
+	for _, window := range client.sendWindows.Drain() {
+		window.Close()
+	}
+	client.recvWindows.Drain()
+	client.halfClosed.Drain()
+	for _, cl := range client.clientsTCP.Drain() {
+		cl.Close()
+	}
+	for _, cl := range client.clientsUDP.Drain() {
+		cl.Close()
+	}
+}
+
+// Reconnect with exponential backoff and jitter until connected or agent closed
+func (client *Client) reconnect() error {
+	client.online.Store(false)
+	client.conn().Close()
+	for delay := ReconnectMin; ; delay = min(delay*2, ReconnectMax) {
+		select {
+		case <-client.closing:
+			return nil
+		case <-time.After(delay/2 + rand.N(delay/2+1)):
+		}
+
+		err := client.connect()
+		if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrNotListening) || err == secure.ErrServerKey || err == ErrInvalidTransport || errors.Is(err, ErrIncompatible) {
+			return err // Reconnect return same error
+		} else if err != nil {
+			continue
+		} else if client.isClosing() {
+			client.conn().Close()
+			return nil
+		}
+		break
+	}
+
+	// Retransmit data not confirmed in old connection
+	client.tcpStreams.Range(func(_ string, stream *reliable.Stream) bool {
+		stream.Resume()
+		return true
+	})
+	client.online.Store(true)
+	go client.discoverMTU(client.conn())
+	return nil
+}
+
+// Probe path MTU of datagram connection and send size discovered to controller
+func (client *Client) discoverMTU(conn net.Conn) {
+	client.connMu.RLock()
+	hello := client.Hello
+	client.connMu.RUnlock()
+	if !pmtu.IsDatagram(conn) || !hello.Has(proto.CapPathMTU) {
+		return
+	}
+	size := client.prober.Discover(func(size uint16) error {
+		if client.conn() != conn {
+			return net.ErrClosed // Reconnected, new connection start discovery
+		}
+		return proto.WriteRequest(conn, proto.Request{PathMTU: &proto.PathMTU{Size: size, Probe: true}})
+	})
+	if client.conn() != conn {
+		return
+	}
+	client.datagram.Store(uint32(size))
+	proto.WriteRequest(conn, proto.Request{PathMTU: &proto.PathMTU{Size: size}})
+}
+
+// Send ping and close connection if controller stop respond
+func (client *Client) pinger() {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-client.closing:
+			return
+		case <-ticker.C:
+		}
+		if !client.online.Load() {
+			continue // Reconnecting
+		} else if time.Since(time.UnixMilli(client.lastPong.Load())) > PongTimeout {
+			client.conn().Close() // handlers reconnect
+			continue
+		}
+		var now = time.Now()
+		client.Send(proto.Request{Ping: &now})
+	}
+}
+
+func (client *Client) isClosing() bool {
+	select {
+	case <-client.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown client without reason
+func (client *Client) Close(ctx context.Context) error {
+	return client.Shutdown(ctx, "")
+}
+
+// Stop accepting new clients, drain data sent to controller, notify controller and wait confirmation
+func (client *Client) Shutdown(ctx context.Context, reason string) error {
+	err := ErrClosed
+	client.closeOnce.Do(func() { err = client.shutdown(ctx, reason) })
+	return err
+}
+
+func (client *Client) shutdown(ctx context.Context, reason string) error {
+	close(client.closing)
+	defer client.conn().Close()
+
+	// Close local clients, copy goroutines end and only wait acks
+	client.clientsTCP.Range(func(_ string, cl net.Conn) bool {
+		cl.Close()
+		return true
+	})
+	client.clientsUDP.Range(func(_ string, cl net.Conn) bool {
+		cl.Close()
+		return true
+	})
+	client.tcpStreams.Range(func(key string, stream *reliable.Stream) bool {
+		if stream.Flush(ctx); ctx.Err() != nil {
+			return false
+		}
+		stream.Close()
+		client.tcpStreams.Delete(key)
+		return true
 	})
-	if err == nil {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	req := proto.Request{AgentShutdown: &proto.AgentShutdown{Reason: reason}}
+	if client.version() < proto.VersionRequestID {
+		return client.Send(req) // Controller ack without request ID
+	}
+	_, err := client.Call(ctx, req)
+	return err
+}
+
+// Datagram size to controller connection
+func (client *Client) DatagramSize() uint16 {
+	return uint16(client.datagram.Load())
+}
+
+// Max data in one ClientData without fragment
+func (client *Client) dataSize() int {
+	return int(client.DatagramSize() - proto.DataOverhead)
+}
+
+// Send data to controller, data bigger than datagram size is fragmented
+func (client *Client) sendData(To proto.Client, Seq uint64, w []byte) error {
+	fragments, err := fragment.Split(proto.ClientData{Client: To, Seq: Seq, Size: uint64(len(w)), Data: w}, client.dataSize(), client.fragID.Add(1))
+	if err != nil {
+		return err
+	}
+	for index := range fragments {
+		if err := client.Send(proto.Request{DataTX: &fragments[index]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type toWr struct {
+	To     proto.Client
+	tun    *Client
+	stream *reliable.Stream // Sequence data to TCP clients
+	window *flow.Send       // Credit to send data to TCP clients
+}
+
+// Split stream data in chunks fit in datagram and send to other side, UDP datagram is sent complete
+func (t toWr) Write(w []byte) (n int, err error) {
+	if t.stream == nil {
+		if err = t.tun.sendData(t.To, 0, w); err != nil {
+			return 0, err
+		}
 		return len(w), nil
 	}
-	return 0, err
+	for len(w) > 0 {
+		chunk := w[:min(len(w), t.tun.dataSize())]
+		var size int
+		if size, err = t.window.Acquire(len(chunk)); err != nil {
+			return // Block until controller consume data
+		}
+		chunk = chunk[:size]
+		if _, err = t.stream.Write(chunk); err != nil {
+			return
+		}
+		n += len(chunk)
+		w = w[len(chunk):]
+	}
+	return
+}
+
+func (tun *Client) GetTargetWrite(To proto.Client) io.Writer {
+	wr := &toWr{To: To, tun: tun}
+	if To.Proto == proto.ProtoTCP {
+		wr.stream, _ = tun.tcpStreams.Load(To.Key())
+		wr.window = tun.sendWindow(To)
+	}
+	return wr
+}
+
+// Credit to send data to TCP client, created on first data or window update from controller
+func (client *Client) sendWindow(To proto.Client) *flow.Send {
+	if window, ok := client.sendWindows.Load(To.Key()); ok {
+		return window
+	}
+	window, _ := client.sendWindows.LoadOrStore(To.Key(), flow.NewSend(proto.InitialWindow, func(limit uint64) error {
+		return client.Send(proto.Request{WindowUpdate: &proto.WindowUpdate{Client: To, Limit: limit, Probe: true}})
+	}))
+	return window
 }
 
-func (tun *Client) GetTargetWrite(Proto uint8, To netip.AddrPort) io.Writer {
-	return &toWr{Proto: Proto, To: To, tun: tun}
+// Bytes queued to TCP client, fit full stream window so controller requests not block
+// whatever the segment size, window is consumed after queue write data to client
+func streamQueueBytes() int {
+	return int(max(StreamWindow, proto.InitialWindow))
+}
+
+// Create reliable stream to TCP client
+func (client *Client) newStream(cl net.Conn, To proto.Client) *reliable.Stream {
+	cc, err := congestion.New(Congestion, reliable.Window)
+	if err != nil {
+		cc = congestion.NewNewReno(reliable.Window)
+	}
+	return reliable.NewStreamCongestion(cc, func(seq uint64, data []byte) error {
+		return client.sendData(To, seq, data)
+	}, func(ack uint64) error {
+		return client.Send(proto.Request{DataAck: &proto.ClientAck{Client: To, Ack: ack}})
+	}, func(data []byte) error {
+		_, err := cl.Write(data)
+		return err
+	})
 }
 
+// Congestion control state of TCP client streams, key is client key
+func (client *Client) CongestionStats() map[string]congestion.Stats {
+	stats := make(map[string]congestion.Stats)
+	client.tcpStreams.Range(func(key string, stream *reliable.Stream) bool {
+		stats[key] = stream.Congestion()
+		return true
+	})
+	return stats
+}
+
+// Write queue stats of clients, key is protocol and client key
+func (client *Client) QueueStats() map[string]queue.Stats {
+	stats := make(map[string]queue.Stats)
+	client.clientsTCP.Range(func(key string, cl net.Conn) bool {
+		if cl, ok := cl.(*queue.Conn); ok {
+			stats["tcp/"+key] = cl.Stats()
+		}
+		return true
+	})
+	return stats
+}
+
+// Pipe buffer stats of clients, bytes waiting local connection read, key is protocol and client key
+func (client *Client) PipeStats() map[string]pipe.Stats {
+	stats := make(map[string]pipe.Stats)
+	client.clientsTCP.Range(func(key string, cl net.Conn) bool {
+		if cl, ok := cl.(*queue.Conn); ok {
+			if conn, ok := cl.Conn.(*pipe.BufferedConn); ok {
+				stats["tcp/"+key] = conn.Stats()
+			}
+		}
+		return true
+	})
+	client.clientsUDP.Range(func(key string, cl net.Conn) bool {
+		if conn, ok := cl.(*pipe.BufferedConn); ok {
+			stats["udp/"+key] = conn.Stats()
+		}
+		return true
+	})
+	return stats
+}
+
+// Create local pipe to client and emit in NewClient if client not exists,
+// client is registered before emit so Reject after receive find it
+func (client *Client) accept(remote proto.Client) {
+	if remote.Proto == proto.ProtoTCP {
+		if _, ok := client.clientsTCP.Load(remote.Key()); ok {
+			return
+		}
+		addr := net.TCPAddrFromAddrPort(remote.Client)
+		toClient, toAgent := pipe.CreateBufferedPipe(addr, addr, pipe.BufferConfig{Capacity: PipeBuffer}) // Slow target not block other clients
+		window := flow.NewRecv(proto.InitialWindow, StreamWindow, func(limit uint64) error {
+			return client.Send(proto.Request{WindowUpdate: &proto.WindowUpdate{Client: remote, Limit: limit}})
+		})
+		client.recvWindows.Store(remote.Key(), window)
+		cl := queue.NewConnBytes(toAgent, streamQueueBytes(), window.Consume)
+		client.clientsTCP.Store(remote.Key(), cl)
+		stream := client.newStream(cl, remote)
+		client.tcpStreams.Store(remote.Key(), stream)
+		go func() {
+			_, err := io.Copy(client.GetTargetWrite(remote), toAgent)
+			client.localCloseTCP(remote, cl, err)
+		}()
+		client.NewClient <- NewClient{
+			Client: remote,
+			Writer: toClient,
+		}
+	} else if remote.Proto == proto.ProtoUDP {
+		if _, ok := client.clientsUDP.Load(remote.Key()); ok {
+			return
+		}
+		addr := net.UDPAddrFromAddrPort(remote.Client)
+		toClient, toAgent := pipe.CreateBufferedPipe(addr, addr, pipe.BufferConfig{Capacity: PipeBuffer, Packet: true, Drop: true})
+		client.clientsUDP.Store(remote.Key(), toAgent) // Write not wait target, datagrams dropped if target not reading
+		go func() {
+			io.CopyBuffer(client.GetTargetWrite(remote), toAgent, make([]byte, proto.MaxDataSize)) // Read full datagram
+			if client.clientsUDP.CompareAndDelete(remote.Key(), toAgent) {
+				client.closeRemote(remote, "")
+			}
+			toAgent.Close()
+		}()
+		client.NewClient <- NewClient{
+			Client: remote,
+			Writer: toClient,
+		}
+	}
+}
+
+// Target cannot be dialed to client, close client and send reason to controller reset client connection
+func (client *Client) Reject(remote proto.Client, reason string) error {
+	if reason == "" {
+		reason = "target unavailable"
+	}
+	var cl net.Conn
+	var ok bool
+	if remote.Proto == proto.ProtoTCP {
+		cl, ok = client.clientsTCP.LoadAndDelete(remote.Key())
+	} else {
+		cl, ok = client.clientsUDP.LoadAndDelete(remote.Key())
+	}
+	if !ok {
+		return nil // Closed by controller
+	}
+	cl.Close()
+	return client.closeRemote(remote, reason)
+}
+
+// Release client and request controller close client connection, reason set if target not dialed
+func (client *Client) closeRemote(remote proto.Client, reason string) error {
+	client.fragments.Delete(remote)
+	if remote.Proto == proto.ProtoTCP {
+		client.releaseTCP(remote)
+	}
+	kind := proto.CloseFull
+	if reason != "" {
+		kind = proto.CloseAbort // Controller reset client
+	}
+	close := proto.ClientClose{Client: remote, Kind: kind, Reason: reason}.For(client.version())
+	return client.Send(proto.Request{ClientClose: &close})
+}
+
+// Local target stop send data, send close to controller after controller acknowledge data sent before
+func (client *Client) localCloseTCP(remote proto.Client, cl net.Conn, err error) {
+	if current, ok := client.clientsTCP.Load(remote.Key()); !ok || current != cl {
+		return // Closed by controller
+	}
+	kind := proto.CloseFull
+	if pipe.IsReset(err) {
+		kind = proto.CloseAbort
+	} else if err == nil {
+		kind = proto.CloseWrite
+		if stream, ok := client.tcpStreams.Load(remote.Key()); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
+			stream.Flush(ctx)
+			cancel()
+		}
+	}
+	close := proto.ClientClose{Client: remote, Kind: kind}.For(client.version()) // Old controllers close full connection
+	client.Send(proto.Request{ClientClose: &close})
+	if close.Kind == proto.CloseWrite && !client.halfClose(remote) {
+		return // Controller still send data to target
+	}
+	if cl, ok := client.releaseTCP(remote); ok {
+		cl.Close()
+	}
+}
+
+// Controller closed TCP client, shutdown write, close or reset pipe to target
+func (client *Client) peerCloseTCP(remote proto.Client, kind uint8) {
+	if kind == proto.CloseWrite && !client.halfClose(remote) {
+		if cl, ok := client.clientsTCP.Load(remote.Key()); ok {
+			pipe.CloseWrite(cl) // Target still send data to controller
+		}
+		return
+	}
+	cl, ok := client.releaseTCP(remote)
+	if !ok {
+		return
+	} else if kind == proto.CloseAbort {
+		pipe.Abort(cl) // Client reset, target read connection reset
+		return
+	}
+	cl.Close()
+}
+
+// One direction of TCP client closed, true if other direction closed before
+func (client *Client) halfClose(remote proto.Client) bool {
+	_, closed := client.halfClosed.LoadOrStore(remote.Key(), true)
+	return closed
+}
+
+// Remove TCP client state, return pipe to target if not removed before
+func (client *Client) releaseTCP(remote proto.Client) (net.Conn, bool) {
+	if stream, ok := client.tcpStreams.LoadAndDelete(remote.Key()); ok {
+		stream.Close()
+	}
+	if window, ok := client.sendWindows.LoadAndDelete(remote.Key()); ok {
+		window.Close()
+	}
+	client.recvWindows.Delete(remote.Key())
+	client.halfClosed.Delete(remote.Key())
+	client.fragments.Delete(remote)
+	return client.clientsTCP.LoadAndDelete(remote.Key())
+}
+
+// Process responses and reconnect when connection is lost
 func (client *Client) handlers() {
-	bufioBuff := bufio.NewReader(client.Conn)
-	var lastPing int64 = 0
 	for {
-		if time.Now().UnixMilli()-lastPing > 3_000 {
-			var now = time.Now()
-			go client.Send(proto.Request{Ping: &now})
+		err := client.serve()
+		if client.isClosing() {
+			close(client.NewClient)
+			return
+		} else if err == nil || !(errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrNotListening)) {
+			err = client.reconnect()
+		}
+		if err != nil {
+			client.err = err
+			client.closeOnce.Do(func() {
+				close(client.closing)
+				client.conn().Close()
+			})
+			close(client.NewClient)
+			return
 		}
+	}
+}
 
-		res, err := proto.ReaderResponse(bufioBuff)
+// Process responses from current connection, return nil if controller request new auth
+func (client *Client) serve() error {
+	client.connMu.RLock()
+	conn, reader, hello := client.Conn, client.reader, client.Hello
+	client.connMu.RUnlock()
+	for {
+		res, err := proto.ReaderResponse(reader)
 
 		if err != nil {
 			fmt.Println(err)
-			if err == proto.ErrInvalidBody {
+			if skipFrame(conn, reader, err) {
 				continue
 			}
-			panic(err) // TODO: Require fix to agent shutdown graced
+			return err
 		}
+		client.lastPong.Store(time.Now().UnixMilli())
 
 		d, _ := json.Marshal(res)
 		fmt.Println(string(d))
 
-		if res.Pong != nil {
-			lastPing = res.Pong.UnixMilli()
+		if wait, ok := client.pending.LoadAndDelete(res.ID); ok {
+			wait <- res // Call own response
 			continue
-		}
-		if res.Unauthorized || res.NotListened {
-			panic(fmt.Errorf("cannot recive requests")) // TODO: Require fix to agent shutdown graced
-		} else if res.SendAuth {
-			var auth = proto.AgentAuth(client.Token)
-			for {
-				client.Send(proto.Request{AgentAuth: &auth})
-				res, err := proto.ReaderResponse(client.Conn)
-				if err != nil {
-					panic(err) // TODO: Require fix to agent shutdown graced
-				} else if res.Unauthorized {
-					return
-				} else if res.AgentInfo == nil {
-					continue
-				}
-				client.AgentInfo = res.AgentInfo
-				break
+		} else if res.Pong != nil || res.ShutdownAck {
+			continue
+		} else if resErr := res.Error; res.Error != nil {
+			if errors.Is(resErr, ErrUnauthorized) {
+				return resErr
+			} else if resErr.IsListen() {
+				return fmt.Errorf("%w: %w", ErrNotListening, resErr)
 			}
-		} else if cl := res.CloseClient; res.CloseClient != nil {
-			if cl.Proto == proto.ProtoTCP {
-				if tun, ok := client.clientsTCP[cl.Client.String()]; ok {
-					tun.Close()
-				}
+			fmt.Println(resErr) // Request not processed
+			continue
+		} else if res.SendAuth {
+			return nil // Controller lost session, reconnect and resume
+		} else if clClose := res.CloseClient; res.CloseClient != nil {
+			if cl := clClose.Client; cl.Proto == proto.ProtoTCP {
+				client.peerCloseTCP(cl, clClose.Kind)
 			} else if cl.Proto == proto.ProtoUDP {
-				if tun, ok := client.clientsUDP[cl.Client.String()]; ok {
+				client.fragments.Delete(cl)
+				if tun, ok := client.clientsUDP.LoadAndDelete(cl.Key()); ok {
 					tun.Close()
 				}
 			}
+		} else if cl := res.NewClient; res.NewClient != nil {
+			if !client.isClosing() {
+				client.accept(*cl) // Dial target before client send data
+			}
 		} else if data := res.DataRX; res.DataRX != nil {
-			if data.Client.Proto == proto.ProtoTCP {
-				if _, ok := client.clientsTCP[data.Client.Client.String()]; !ok {
-					toClient, toAgent := pipe.CreatePipe(net.TCPAddrFromAddrPort(data.Client.Client), net.TCPAddrFromAddrPort(data.Client.Client))
-					client.NewClient <- NewClient{
-						Client: data.Client,
-						Writer: toClient,
-					}
-					client.clientsTCP[data.Client.Client.String()] = toAgent
-					go func() {
-						io.Copy(client.GetTargetWrite(proto.ProtoTCP, data.Client.Client), toAgent)
-						delete(client.clientsTCP, data.Client.Client.String())
-					}()
-				}
-			} else if data.Client.Proto == proto.ProtoUDP {
-				if _, ok := client.clientsUDP[data.Client.Client.String()]; !ok {
-					toClient, toAgent := pipe.CreatePipe(net.UDPAddrFromAddrPort(data.Client.Client), net.UDPAddrFromAddrPort(data.Client.Client))
-					client.NewClient <- NewClient{
-						Client: data.Client,
-						Writer: toClient,
-					}
-					client.clientsUDP[data.Client.Client.String()] = toAgent
-					go func() {
-						io.Copy(client.GetTargetWrite(proto.ProtoUDP, data.Client.Client), toAgent)
-						delete(client.clientsUDP, data.Client.Client.String())
-						toAgent.Close()
-					}()
-				}
+			if client.isClosing() {
+				continue // Not accept new clients and data to closed clients
+			} else if data = client.fragments.Add(data); data == nil {
+				continue // Wait all fragments
+			}
+			if !hello.Has(proto.CapNewClient) {
+				client.accept(data.Client) // Controller not announce clients, late data to closed client not dial again
 			}
 
 			if data.Client.Proto == proto.ProtoTCP {
-				if tun, ok := client.clientsTCP[data.Client.Client.String()]; ok {
-					go tun.Write(data.Data)
+				if stream, ok := client.tcpStreams.Load(data.Client.Key()); ok {
+					stream.Receive(data.Seq, data.Data) // Stream deliver in order to client queue
 				}
 			} else if data.Client.Proto == proto.ProtoUDP {
-				if tun, ok := client.clientsUDP[data.Client.Client.String()]; ok {
-					go tun.Write(data.Data)
+				if tun, ok := client.clientsUDP.Load(data.Client.Key()); ok {
+					tun.Write(data.Data) // Dropped if target not reading, like UDP socket
 				}
 			} else if res.Pong != nil {
 				fmt.Println(res.Pong.String())
 			}
+		} else if update := res.WindowUpdate; res.WindowUpdate != nil {
+			if update.Probe {
+				if window, ok := client.recvWindows.Load(update.Client.Key()); ok {
+					window.Advertise() // Controller lost last update
+				}
+			} else if update.Client.Proto == proto.ProtoTCP {
+				client.sendWindow(update.Client).Update(update.Limit)
+			}
+		} else if ack := res.DataAck; res.DataAck != nil {
+			if ack.Client.Proto == proto.ProtoTCP {
+				if stream, ok := client.tcpStreams.Load(ack.Client.Key()); ok {
+					stream.Ack(ack.Ack)
+				}
+			}
+		} else if mtu := res.PathMTU; res.PathMTU != nil {
+			client.prober.Echo(mtu.Size)
 		}
 	}
 }
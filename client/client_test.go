@@ -0,0 +1,214 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/client"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pipe"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/server"
+)
+
+// Controller calls with one tunnel to any token
+type calls struct {
+	mappings []proto.Mapping
+
+	mu       sync.Mutex
+	rejected []string // Reasons of clients rejected by agent
+}
+
+func (calls *calls) AgentAuthentication(Token [36]byte) (server.TunnelInfo, error) {
+	return server.TunnelInfo{Mappings: calls.mappings, Callbacks: calls}, nil
+}
+
+func (calls *calls) BlockedAddr(AddrPort string) bool                        { return false }
+func (calls *calls) AgentPing(agent, server time.Time)                       {}
+func (calls *calls) AgentShutdown(onTime time.Time, reason string)           {}
+func (calls *calls) RegisterRX(client netip.AddrPort, Size int, Proto uint8) {}
+func (calls *calls) RegisterTX(client netip.AddrPort, Size int, Proto uint8) {}
+func (calls *calls) DialFailed(client proto.Client, reason string) {
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+	calls.rejected = append(calls.rejected, reason)
+}
+
+func (calls *calls) rejects() []string {
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+	return append([]string(nil), calls.rejected...)
+}
+
+// Controller on loopback and agent connected with transport, mappings listen system assigned ports
+func connect(t *testing.T, transport string, mappings ...proto.Mapping) (*calls, *client.Client) {
+	calls := &calls{mappings: mappings}
+	controller, err := server.NewControllerConfig(calls, netip.MustParseAddrPort("127.0.0.1:0"), server.ControllerConfig{Transports: []string{transport}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { controller.Close() })
+
+	var addr net.Addr
+	if controller.ControllConn != nil {
+		addr = controller.ControllConn.Addr()
+	} else {
+		addr = controller.ControllStream.Addr()
+	}
+	agent, err := client.CreateClientConfig([]netip.AddrPort{netip.MustParseAddrPort(addr.String())}, [36]byte{}, client.ClientConfig{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		agent.Close(ctx)
+	})
+	return calls, agent
+}
+
+// Public address of mapping listened by controller
+func mappingAddr(t *testing.T, agent *client.Client, id uint16) string {
+	mapping, ok := agent.Info().Mapping(id)
+	if !ok {
+		t.Fatalf("mapping %d not listened", id)
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(mapping.Port)))
+}
+
+// Agent reject client right after receive, controller must close public connection
+func TestRejectAfterReceive(t *testing.T) {
+	for _, transport := range []string{proto.TransportUDP, proto.TransportTCP} {
+		t.Run(transport, func(t *testing.T) {
+			calls, agent := connect(t, transport, proto.Mapping{ID: 1, Name: "game", Proto: proto.ProtoTCP})
+			go func() {
+				for newClient := range agent.NewClient {
+					agent.Reject(newClient.Client, "mapping without target")
+				}
+			}()
+
+			const clients = 20
+			addr := mappingAddr(t, agent, 1)
+			for index := 0; index < clients; index++ {
+				conn, err := net.Dial("tcp", addr)
+				if pipe.IsReset(err) {
+					continue // Reset before dial return
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err = conn.Read(make([]byte, 1)); err == nil {
+					t.Fatal("rejected client read data")
+				} else if opt, ok := err.(net.Error); ok && opt.Timeout() {
+					t.Fatalf("client %d not closed after agent reject", index)
+				}
+				conn.Close()
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for len(calls.rejects()) < clients && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if rejects := calls.rejects(); len(rejects) != clients {
+				t.Fatalf("controller recived %d of %d rejects", len(rejects), clients)
+			} else if rejects[0] != "mapping without target" {
+				t.Fatalf("reject reason %q", rejects[0])
+			}
+		})
+	}
+}
+
+// Echo data of clients back through tunnel
+func echo(agent *client.Client) {
+	for newClient := range agent.NewClient {
+		go func(conn net.Conn, datagram bool) {
+			defer conn.Close()
+			if !datagram {
+				io.Copy(conn, conn)
+				return
+			}
+			buff := make([]byte, proto.MaxDataSize)
+			for {
+				n, err := conn.Read(buff)
+				if err != nil {
+					return
+				} else if _, err = conn.Write(buff[:n]); err != nil {
+					return
+				}
+			}
+		}(newClient.Writer, newClient.Client.Proto == proto.ProtoUDP)
+	}
+}
+
+// Public client send message and wait echo, UDP resend while echo not recived
+func roundTrip(network, addr, msg string) error {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buff := make([]byte, len(msg))
+	for attempt := 0; attempt < 10; attempt++ {
+		if attempt == 0 || network == "udp" {
+			if _, err = conn.Write([]byte(msg)); err != nil {
+				return err
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = io.ReadFull(conn, buff); err == nil {
+			if string(buff) != msg {
+				return fmt.Errorf("echo %q, sent %q", buff, msg)
+			}
+			return nil
+		} else if opt, ok := err.(net.Error); !ok || !opt.Timeout() || network != "udp" {
+			return err
+		}
+	}
+	return err
+}
+
+// Open and close many public clients at same time, run with -race to check client registries and accessors
+func TestConcurrentClients(t *testing.T) {
+	defer func(old time.Duration) { server.UDPIdleTimeout = old }(server.UDPIdleTimeout)
+	server.UDPIdleTimeout = time.Second // Release UDP clients in test
+
+	const clients, inFlight = 200, 16 // Burst of new clients over UDP transport overflow socket buffers
+	for _, transport := range []string{proto.TransportUDP, proto.TransportTCP} {
+		t.Run(transport, func(t *testing.T) {
+			_, agent := connect(t, transport, proto.Mapping{ID: 1, Name: "echo", Proto: proto.ProtoBoth})
+			go echo(agent)
+
+			addr := mappingAddr(t, agent, 1)
+			var wait sync.WaitGroup
+			slots := make(chan struct{}, inFlight)
+			for index := 0; index < clients; index++ {
+				for _, network := range []string{"tcp", "udp"} {
+					wait.Add(1)
+					slots <- struct{}{}
+					go func(network string, index int) {
+						defer func() { <-slots; wait.Done() }()
+						agent.Info() // Read with agent processing responses
+						if err := roundTrip(network, addr, fmt.Sprintf("%s client %d", network, index)); err != nil {
+							t.Errorf("%s client %d: %s", network, index, err)
+						}
+					}(network, index)
+				}
+			}
+			wait.Wait()
+
+			deadline := time.Now().Add(10 * time.Second)
+			for len(agent.PipeStats()) > 0 && time.Now().Before(deadline) {
+				time.Sleep(50 * time.Millisecond)
+			}
+			if open := agent.PipeStats(); len(open) > 0 {
+				t.Fatalf("%d clients not released by agent", len(open))
+			}
+		})
+	}
+}
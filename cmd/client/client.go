@@ -1,17 +1,39 @@
 package client
 
 import (
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/urfave/cli/v2"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/client"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/congestion"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pipe"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/reliable"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/secure"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
 )
 
+var (
+	ShutdownTimeout = time.Second * 10       // Time to drain clients and wait controller confirm shutdown
+	DialTimeout     = time.Second * 5        // Time to connect to local target
+	DialRetries     = 2                      // Dial attempts after first failure
+	DialRetryDelay  = time.Millisecond * 500 // Wait between dial attempts
+)
+
 var CmdClient = cli.Command{
 	Name:    "client",
 	Aliases: []string{"c"},
@@ -38,10 +60,53 @@ var CmdClient = cli.Command{
 			},
 		},
 		&cli.StringFlag{
-			Name:     "dial",
-			Required: true,
-			Usage:    `dial connection, default is "localhost:80"`,
-			Aliases:  []string{"d"},
+			Name:    "transport",
+			Value:   proto.TransportAuto,
+			Aliases: []string{"T"},
+			Usage:   "controller transport: auto (UDP with fallback to TCP), udp, tcp or tls",
+		},
+		&cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "CA certificate file to verify controller in tls transport",
+		},
+		&cli.BoolFlag{
+			Name:  "tls-insecure",
+			Usage: "skip controller certificate verification in tls transport",
+		},
+		&cli.StringFlag{
+			Name:    "server-key",
+			Aliases: []string{"k"},
+			Usage:   "controller public key (base64) to encrypt connection",
+		},
+		&cli.StringFlag{
+			Name:    "dial",
+			Usage:   `default dial connection to mappings without target, example "localhost:80"`,
+			Aliases: []string{"d"},
+		},
+		&cli.Uint64Flag{
+			Name:  "stream-window",
+			Value: client.StreamWindow,
+			Usage: "bytes controller can send to each TCP client before agent write to client",
+		},
+		&cli.StringFlag{
+			Name:  "congestion",
+			Value: client.Congestion,
+			Usage: "congestion control to TCP client streams, newreno or bbr",
+		},
+		&cli.DurationFlag{
+			Name:  "dial-timeout",
+			Value: DialTimeout,
+			Usage: "timeout to connect to local target",
+		},
+		&cli.IntFlag{
+			Name:  "dial-retries",
+			Value: DialRetries,
+			Usage: "dial attempts to local target after first failure, controller reset client if all fail",
+		},
+		&cli.StringSliceFlag{
+			Name:    "map",
+			Usage:   `dial connection to mapping name, example "java=localhost:25565", can be repeated`,
+			Aliases: []string{"m"},
 		},
 	},
 	Action: func(ctx *cli.Context) (err error) {
@@ -49,34 +114,158 @@ var CmdClient = cli.Command{
 		if addr, err = netip.ParseAddrPort(ctx.String("url")); err != nil {
 			return
 		}
-		client, err := client.CreateClient([]netip.AddrPort{addr}, [36]byte([]byte(ctx.String("token"))))
-		if err != nil {
+		targets := map[string]string{}
+		for _, rule := range ctx.StringSlice("map") {
+			name, target, ok := strings.Cut(rule, "=")
+			if !ok || name == "" || target == "" {
+				return fmt.Errorf("invalid map %q, use name=local:port", rule)
+			}
+			targets[name] = target
+		}
+		if len(targets) == 0 && ctx.String("dial") == "" {
+			return fmt.Errorf("set dial or map to local connections")
+		}
+		tlsConfig := &tls.Config{InsecureSkipVerify: ctx.Bool("tls-insecure")}
+		if caFile := ctx.String("tls-ca"); caFile != "" {
+			caCert, err := os.ReadFile(caFile)
+			if err != nil {
+				return err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+				return fmt.Errorf("cannot load CA certificates from %s", caFile)
+			}
+		}
+		var serverKey *ecdh.PublicKey
+		if key := ctx.String("server-key"); key != "" {
+			raw, err := base64.StdEncoding.DecodeString(key)
+			if err != nil {
+				return err
+			} else if serverKey, err = secure.ParsePublicKey(raw); err != nil {
+				return err
+			}
+		}
+		client.StreamWindow = max(ctx.Uint64("stream-window"), proto.InitialWindow)
+		if _, err := congestion.New(ctx.String("congestion"), reliable.Window); err != nil {
 			return err
 		}
-		fmt.Printf("Connected, Remote address: %s\n", client.AgentInfo.AddrPort.String())
-		if client.AgentInfo.Protocol == proto.ProtoUDP {
-			fmt.Printf("           Port: UDP %d\n", client.AgentInfo.UDPPort)
-		} else if client.AgentInfo.Protocol == proto.ProtoTCP {
-			fmt.Printf("           Port: TCP %d\n", client.AgentInfo.TCPPort)
-		} else if client.AgentInfo.Protocol == proto.ProtoBoth {
-			fmt.Printf("           Ports UDP %d and TCP %d\n", client.AgentInfo.UDPPort, client.AgentInfo.TCPPort)
+		client.Congestion = ctx.String("congestion")
+		DialTimeout, DialRetries = ctx.Duration("dial-timeout"), max(ctx.Int("dial-retries"), 0)
+		agent, err := client.CreateClientConfig([]netip.AddrPort{addr}, [36]byte([]byte(ctx.String("token"))), client.ClientConfig{
+			Transport: ctx.String("transport"),
+			TLSConfig: tlsConfig,
+			ServerKey: serverKey,
+		})
+		if err != nil {
+			return describeError(err)
+		}
+		info, hello := agent.Info(), agent.ControllerHello()
+		fmt.Printf("Connected, Remote address: %s\n", info.AddrPort.String())
+		fmt.Printf("           Controller: %s %s/%s, protocol %d\n", hello.Software, hello.OS, hello.Arch, hello.Version)
+		for _, mapping := range info.Mappings {
+			target, ok := targets[mapping.Name]
+			if !ok {
+				target = ctx.String("dial")
+			}
+			if mapping.Proto == proto.ProtoUDP {
+				fmt.Printf("           Port: UDP %d -> %s\n", mapping.Port, target)
+			} else if mapping.Proto == proto.ProtoTCP {
+				fmt.Printf("           Port: TCP %d -> %s\n", mapping.Port, target)
+			} else if mapping.Proto == proto.ProtoBoth {
+				fmt.Printf("           Ports UDP and TCP %d -> %s\n", mapping.Port, target)
+			}
 		}
 
-		localConnect := ctx.String("dial")
+		signalCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
 		for {
-			client := <-client.NewClient
-			var dial net.Conn
-			if client.Client.Proto == proto.ProtoTCP {
-				if dial, err = net.Dial("tcp", localConnect); err != nil {
-					continue
-				}
-			} else {
-				if dial, err = net.Dial("udp", localConnect); err != nil {
-					continue
+			var newClient client.NewClient
+			var ok bool
+			select {
+			case <-signalCtx.Done():
+				fmt.Println("Shutting down agent")
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+				defer cancel()
+				return agent.Shutdown(shutdownCtx, "agent stopped")
+			case newClient, ok = <-agent.NewClient:
+				if !ok {
+					return describeError(agent.Err()) // Agent cannot reconnect
 				}
 			}
-			go io.Copy(client.Writer, dial)
-			go io.Copy(dial, client.Writer)
+
+			mapping, _ := agent.Info().Mapping(newClient.Client.Mapping) // Mappings can change on reconnect
+			localConnect, ok := targets[mapping.Name]
+			if !ok {
+				localConnect = ctx.String("dial")
+			}
+
+			if localConnect == "" {
+				agent.Reject(newClient.Client, "mapping without target")
+				continue
+			}
+			go func() {
+				network := "udp"
+				if newClient.Client.Proto == proto.ProtoTCP {
+					network = "tcp"
+				}
+				dial, err := dialTarget(network, localConnect)
+				if err != nil {
+					fmt.Printf("Cannot connect client %s to %s: %s\n", newClient.Client.Client, localConnect, err)
+					agent.Reject(newClient.Client, err.Error()) // Controller reset client
+					return
+				}
+				proxy(newClient.Writer, dial)
+			}()
 		}
 	},
 }
+
+// Dial local target with DialTimeout, retry DialRetries times before fail
+func dialTarget(network, address string) (conn net.Conn, err error) {
+	for attempt := 0; attempt <= DialRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(DialRetryDelay)
+		}
+		if conn, err = net.DialTimeout(network, address, DialTimeout); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Copy data in both directions until both end, close both connections after
+func proxy(remote, local net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		halfCopy(remote, local)
+	}()
+	halfCopy(local, remote)
+	<-done
+	remote.Close()
+	local.Close()
+}
+
+// Copy src to dst, shutdown dst write on EOF and reset dst if src reset
+func halfCopy(dst, src net.Conn) {
+	_, err := io.CopyBuffer(dst, src, make([]byte, 0xffff)) // Read full UDP datagram
+	if err == nil {
+		pipe.CloseWrite(dst) // Peer still send data, HTTP/1.0 clients wait response after shutdown write
+	} else if pipe.IsReset(err) {
+		pipe.Abort(dst)
+	} else {
+		dst.Close()
+	}
+}
+
+// Add controller error code and related client to error
+func describeError(err error) error {
+	var resErr *proto.Error
+	if !errors.As(err, &resErr) {
+		return err
+	} else if resErr.Client != nil {
+		return fmt.Errorf("%w (code %d, client %s)", err, resErr.Code, resErr.Client.Client)
+	}
+	return fmt.Errorf("%w (code %d)", err, resErr.Code)
+}
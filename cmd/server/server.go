@@ -1,9 +1,20 @@
 package server
 
 import (
+	"crypto/ecdh"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/netip"
+	"os"
+	"strings"
 
 	"github.com/urfave/cli/v2"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/congestion"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/reliable"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/secure"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/server"
 )
 
@@ -16,7 +27,7 @@ var CmdServer = cli.Command{
 			Name:    "port",
 			Value:   5522,
 			Aliases: []string{"p"},
-			Usage:   "Set controller port to watcher UDP requests",
+			Usage:   "Set controller port to watcher UDP and TCP requests",
 		},
 		&cli.StringFlag{
 			Name:    "log",
@@ -24,6 +35,69 @@ var CmdServer = cli.Command{
 			Aliases: []string{"l"},
 			Usage:   "set server log: silence, 0 or verbose, 2",
 		},
+		&cli.StringSliceFlag{
+			Name:    "transport",
+			Value:   cli.NewStringSlice(proto.TransportUDP, proto.TransportTCP),
+			Aliases: []string{"T"},
+			Usage:   "controller transports to listen: udp, tcp or tls (tcp and tls cannot be used together)",
+		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "certificate file to tls transport",
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "certificate key file to tls transport",
+		},
+		&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "controller private key file to encrypt agents connections, created if not exists",
+		},
+		&cli.DurationFlag{
+			Name:  "agent-timeout",
+			Value: server.AgentTimeout,
+			Usage: "close tunnel if agent not send ping in this time",
+		},
+		&cli.DurationFlag{
+			Name:  "controller-idle-timeout",
+			Value: server.ControllerIdleTimeout,
+			Usage: "close UDP controller peers without datagrams in this time, must be bigger than agent timeout, 0 to disable",
+		},
+		&cli.IntFlag{
+			Name:  "controller-max-peers",
+			Value: server.ControllerMaxPeers,
+			Usage: "max agents connected to UDP controller, least recently used agent is closed, 0 to unlimited",
+		},
+		&cli.DurationFlag{
+			Name:  "udp-idle-timeout",
+			Value: server.UDPIdleTimeout,
+			Usage: "close tunnel UDP clients without datagrams in this time, 0 to disable",
+		},
+		&cli.IntFlag{
+			Name:  "udp-max-peers",
+			Value: server.UDPMaxPeers,
+			Usage: "max UDP clients per tunnel, least recently used client is closed, 0 to unlimited",
+		},
+		&cli.Uint64Flag{
+			Name:  "stream-window",
+			Value: server.StreamWindow,
+			Usage: "bytes agent can send to each TCP client before controller write to client",
+		},
+		&cli.StringFlag{
+			Name:  "congestion",
+			Value: server.Congestion,
+			Usage: "congestion control to TCP client streams, newreno or bbr",
+		},
+		&cli.StringFlag{
+			Name:  "port-range",
+			Usage: `ports to assign to mappings without port or port in use, example "20000-20100"`,
+		},
+		&cli.DurationFlag{
+			Name:  "port-reserve-ttl",
+			Value: server.PortReserveTTL,
+			Usage: "keep port assigned to mapping of closed tunnel in this time, 0 to keep forever",
+		},
 		&cli.StringFlag{
 			Name:    "db",
 			Value:   "./pproxit.db",
@@ -32,14 +106,73 @@ var CmdServer = cli.Command{
 		},
 	},
 	Action: func(ctx *cli.Context) error {
+		server.AgentTimeout = ctx.Duration("agent-timeout")
+		server.ControllerIdleTimeout, server.ControllerMaxPeers = ctx.Duration("controller-idle-timeout"), ctx.Int("controller-max-peers")
+		if server.ControllerIdleTimeout != 0 && server.ControllerIdleTimeout <= server.AgentTimeout {
+			return fmt.Errorf("controller idle timeout %s must be bigger than agent timeout %s", server.ControllerIdleTimeout, server.AgentTimeout)
+		}
+		server.StreamWindow = max(ctx.Uint64("stream-window"), proto.InitialWindow)
+		if _, err := congestion.New(ctx.String("congestion"), reliable.Window); err != nil {
+			return err
+		}
+		server.Congestion = ctx.String("congestion")
+		server.UDPIdleTimeout, server.UDPMaxPeers = ctx.Duration("udp-idle-timeout"), ctx.Int("udp-max-peers")
+		server.PortReserveTTL = ctx.Duration("port-reserve-ttl")
 		calls, err := NewCall(ctx.String("db"))
 		if err != nil {
 			return err
 		}
-		pproxitServer, err := server.NewController(calls, netip.AddrPortFrom(netip.IPv4Unspecified(), uint16(ctx.Int("port"))))
+		var tlsConfig *tls.Config
+		if ctx.String("tls-cert") != "" || ctx.String("tls-key") != "" {
+			cert, err := tls.LoadX509KeyPair(ctx.String("tls-cert"), ctx.String("tls-key"))
+			if err != nil {
+				return err
+			}
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		var privateKey *ecdh.PrivateKey
+		if keyFile := ctx.String("key"); keyFile != "" {
+			if privateKey, err = loadKey(keyFile); err != nil {
+				return err
+			}
+			fmt.Printf("Controller public key: %s\n", base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()))
+		}
+		var portPool *server.PortPool
+		if portRange := ctx.String("port-range"); portRange != "" {
+			if portPool, err = server.ParsePortRange(portRange); err != nil {
+				return err
+			} else if err = calls.LoadReservations(portPool); err != nil {
+				return err
+			}
+		}
+		pproxitServer, err := server.NewControllerConfig(calls, netip.AddrPortFrom(netip.IPv4Unspecified(), uint16(ctx.Int("port"))), server.ControllerConfig{
+			Transports: ctx.StringSlice("transport"),
+			TLSConfig:  tlsConfig,
+			PrivateKey: privateKey,
+			PortPool:   portPool,
+		})
 		if err != nil {
 			return err
 		}
 		return <-pproxitServer.ProcessError
 	},
 }
+
+// Load base64 private key from file or create new key
+func loadKey(keyFile string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := secure.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		return key, os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key.Bytes())+"\n"), 0600)
+	} else if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	return secure.ParsePrivateKey(raw)
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	_ "modernc.org/sqlite"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/server"
 	"xorm.io/xorm"
 	"xorm.io/xorm/names"
@@ -33,6 +34,19 @@ type Tun struct {
 	UDPListen uint16   // Port listen UDP agent
 }
 
+type Mapping struct {
+	ID    int64  `xorm:"pk"`                   // Mapping ID
+	TunID int64  `xorm:"notnull"`              // Tunnel ID
+	Name  string `xorm:"varchar(255) notnull"` // Agent target name
+	Proto uint8  `xorm:"default 3"`            // Proto accept
+	Port  uint16 `xorm:"notnull"`              // Port listen
+}
+
+type PortReservation struct {
+	Owner string `xorm:"varchar(255) pk"` // Tunnel mapping, server.PortOwner
+	Port  uint16 `xorm:"notnull"`         // Port reserved in pool
+}
+
 type Ping struct {
 	ID         int64     `json:"-" xorm:"pk"` // Tunnel ID
 	TunID      int64     `json:"-"`
@@ -56,6 +70,16 @@ type RTX struct {
 	Proto  uint8
 }
 
+type DialFailure struct {
+	ID      int64 `json:"-" xorm:"pk autoincr"`
+	TunID   int64 `json:"-"`
+	Client  netip.AddrPort
+	Mapping uint16
+	Proto   uint8
+	Reason  string
+	Time    time.Time
+}
+
 func NewCall(DBConn string) (call *serverCalls, err error) {
 	call = new(serverCalls)
 	if call.XormEngine, err = xorm.NewEngine("sqlite", DBConn); err != nil {
@@ -66,18 +90,44 @@ func NewCall(DBConn string) (call *serverCalls, err error) {
 	defer session.Close()
 	session.CreateTable(User{})
 	session.CreateTable(Tun{})
+	session.CreateTable(Mapping{})
+	session.CreateTable(PortReservation{})
 	session.CreateTable(AddrBlocked{})
 	session.CreateTable(Ping{})
 	session.CreateTable(RTX{})
+	session.CreateTable(DialFailure{})
 	return
 }
 
+// Restore ports reserved to tunnels and save new reservations
+func (caller *serverCalls) LoadReservations(pool *server.PortPool) error {
+	var reservations []PortReservation
+	if err := caller.XormEngine.Find(&reservations); err != nil {
+		return err
+	}
+	for _, reservation := range reservations {
+		if !pool.Reserve(reservation.Owner, reservation.Port) {
+			caller.XormEngine.Delete(&PortReservation{Owner: reservation.Owner}) // Port out of new range
+		}
+	}
+	pool.OnReserve = func(owner string, port uint16) {
+		caller.XormEngine.Delete(&PortReservation{Owner: owner})
+		if _, err := caller.XormEngine.InsertOne(&PortReservation{Owner: owner, Port: port}); err != nil {
+			fmt.Println(err)
+		}
+	}
+	pool.OnRelease = func(owner string) {
+		caller.XormEngine.Delete(&PortReservation{Owner: owner})
+	}
+	return nil
+}
+
 type TunCallbcks struct {
 	tunID      int64
 	XormEngine *xorm.Engine
 }
 
-func (tun *TunCallbcks) AgentShutdown(onTime time.Time) {}
+func (tun *TunCallbcks) AgentShutdown(onTime time.Time, reason string) {}
 
 func (tun *TunCallbcks) BlockedAddr(AddrPort string) bool {
 	var addr = AddrBlocked{Address: AddrPort, TunID: tun.tunID}
@@ -130,6 +180,17 @@ func (tun *TunCallbcks) RegisterTX(client netip.AddrPort, Size int, Proto uint8)
 	})
 }
 
+func (tun *TunCallbcks) DialFailed(client proto.Client, reason string) {
+	tun.XormEngine.InsertOne(&DialFailure{
+		TunID:   tun.tunID,
+		Client:  client.Client,
+		Mapping: client.Mapping,
+		Proto:   client.Proto,
+		Reason:  reason,
+		Time:    time.Now(),
+	})
+}
+
 func (caller *serverCalls) AgentAuthentication(Token [36]byte) (server.TunnelInfo, error) {
 	var tun = Tun{Token: Token}
 	if ok, err := caller.XormEngine.Get(&tun); err != nil || !ok {
@@ -138,10 +199,26 @@ func (caller *serverCalls) AgentAuthentication(Token [36]byte) (server.TunnelInf
 		}
 		return server.TunnelInfo{}, err
 	}
-	return server.TunnelInfo{
-		Proto:     tun.Proto,
-		TCPPort:   tun.TPCListen,
-		UDPPort:   tun.UDPListen,
-		Callbacks: &TunCallbcks{tunID: tun.ID, XormEngine: caller.XormEngine},
-	}, nil
+	var maps []Mapping
+	if err := caller.XormEngine.Asc("ID").Find(&maps, &Mapping{TunID: tun.ID}); err != nil {
+		return server.TunnelInfo{}, err
+	}
+	info := server.TunnelInfo{Callbacks: &TunCallbcks{tunID: tun.ID, XormEngine: caller.XormEngine}}
+	for _, mapping := range maps {
+		if mapping.ID < 0 || mapping.ID > 0xffff {
+			return server.TunnelInfo{}, fmt.Errorf("mapping %d: id not fit in protocol mapping id", mapping.ID)
+		}
+		// Database ID keep mapping ID same after mappings added or removed
+		info.Mappings = append(info.Mappings, proto.Mapping{ID: uint16(mapping.ID), Name: mapping.Name, Proto: mapping.Proto, Port: mapping.Port})
+	}
+	if len(info.Mappings) == 0 {
+		// Tunnel without mappings, listen ports from tunnel to default agent target
+		if tun.Proto == proto.ProtoTCP || tun.Proto == proto.ProtoBoth {
+			info.Mappings = append(info.Mappings, proto.Mapping{ID: 0, Proto: proto.ProtoTCP, Port: tun.TPCListen})
+		}
+		if tun.Proto == proto.ProtoUDP || tun.Proto == proto.ProtoBoth {
+			info.Mappings = append(info.Mappings, proto.Mapping{ID: 1, Proto: proto.ProtoUDP, Port: tun.UDPListen})
+		}
+	}
+	return info, nil
 }
@@ -5,6 +5,7 @@ go 1.22.3
 require (
 	github.com/google/uuid v1.6.0
 	github.com/urfave/cli/v2 v2.27.2
+	golang.org/x/net v0.24.0
 	modernc.org/sqlite v1.30.1
 	xorm.io/xorm v1.3.9
 )
@@ -0,0 +1,164 @@
+// Read and write many datagrams in one syscall, recvmmsg and sendmmsg on Linux
+// and one datagram per syscall on other systems.
+package batch
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/buffer"
+)
+
+var (
+	Size      int = 16       // Datagrams read or written in one syscall
+	QueueSize int = Size * 8 // Datagrams waiting write before Write block
+
+	ErrTooBig error = errors.New("datagram bigger than buffer")
+)
+
+// One datagram to batch read or write
+type Message struct {
+	Buffer []byte         // Read: buffer to fill, Write: datagram
+	N      int            // Bytes read
+	Addr   netip.AddrPort // Read: source, Write: destination, zero in connected socket
+}
+
+// Datagram to write from pooled buffer
+type packet struct {
+	buff *[]byte
+	addr netip.AddrPort
+}
+
+// Queue writes and send in batches from one goroutine, Write copy datagram and return before send
+type Writer struct {
+	conn  *PacketConn
+	queue chan packet
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewWriter(conn *PacketConn) *Writer {
+	writer := &Writer{conn: conn, queue: make(chan packet, QueueSize), done: make(chan struct{})}
+	go writer.loop()
+	return writer
+}
+
+// Queue datagram to addr, block if queue is full
+func (writer *Writer) WriteTo(p []byte, addr netip.AddrPort) (int, error) {
+	if len(p) > buffer.Size {
+		return 0, ErrTooBig
+	}
+	buff := buffer.Get()
+	*buff = append((*buff)[:0], p...)
+	select {
+	case writer.queue <- packet{buff, addr}:
+		return len(p), nil
+	case <-writer.done:
+		buffer.Put(buff)
+		return 0, net.ErrClosed
+	}
+}
+
+// Stop writes, datagrams in queue are dropped
+func (writer *Writer) Close() error {
+	writer.once.Do(func() { close(writer.done) })
+	return nil
+}
+
+func (writer *Writer) loop() {
+	pending := make([]packet, 0, Size)
+	msgs := make([]Message, Size)
+	for {
+		select {
+		case pkt := <-writer.queue:
+			pending = append(pending[:0], pkt)
+		case <-writer.done:
+			return
+		}
+	drain:
+		for len(pending) < Size {
+			select {
+			case pkt := <-writer.queue:
+				pending = append(pending, pkt)
+			default:
+				break drain
+			}
+		}
+
+		for index, pkt := range pending {
+			msgs[index] = Message{Buffer: *pkt.buff, Addr: pkt.addr}
+		}
+		for sent := 0; sent < len(pending); {
+			n, err := writer.conn.WriteBatch(msgs[sent:len(pending)])
+			if err != nil {
+				n = max(n, 1) // Drop datagram with error, UDP not retransmit
+			}
+			sent += n
+		}
+		for index, pkt := range pending {
+			buffer.Put(pkt.buff)
+			msgs[index] = Message{}
+		}
+	}
+}
+
+// Connected UDP socket with batched reads and writes
+type Conn struct {
+	*net.UDPConn
+	batch  *PacketConn
+	writer *Writer
+
+	readMu sync.Mutex
+	msgs   []Message // Datagrams read in last batch
+	buffs  []*[]byte // Pooled buffers of msgs
+	next   int       // Next datagram in msgs to Read
+	count  int       // Datagrams in msgs
+}
+
+// Wrap connected socket, Read return one datagram and Write send one datagram like net.UDPConn
+func NewConn(conn *net.UDPConn) *Conn {
+	batch := NewPacketConn(conn)
+	return &Conn{UDPConn: conn, batch: batch, writer: NewWriter(batch)}
+}
+
+// Read next datagram, datagram bigger than p is truncated
+func (conn *Conn) Read(p []byte) (int, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+	if conn.msgs == nil {
+		conn.msgs, conn.buffs = make([]Message, Size), make([]*[]byte, Size)
+		for index := range conn.msgs {
+			conn.buffs[index] = buffer.Get()
+			conn.msgs[index].Buffer = *conn.buffs[index]
+		}
+	}
+	if conn.next >= conn.count {
+		n, err := conn.batch.ReadBatch(conn.msgs)
+		if err != nil {
+			return 0, err
+		}
+		conn.next, conn.count = 0, n
+	}
+	msg := conn.msgs[conn.next]
+	conn.next++
+	return copy(p, msg.Buffer[:msg.N]), nil
+}
+
+// Queue datagram to batch write
+func (conn *Conn) Write(p []byte) (int, error) {
+	return conn.writer.WriteTo(p, netip.AddrPort{})
+}
+
+func (conn *Conn) Close() error {
+	conn.writer.Close()
+	err := conn.UDPConn.Close()
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+	for _, buff := range conn.buffs {
+		buffer.Put(buff)
+	}
+	conn.msgs, conn.buffs, conn.next, conn.count = nil, nil, 0, 0
+	return err
+}
@@ -0,0 +1,88 @@
+package batch
+
+import (
+	"net"
+	"net/netip"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Batched reads and writes to UDP socket
+type PacketConn struct {
+	conn      *net.UDPConn
+	connected bool // Socket with remote address, write without destination
+	v4        *ipv4.PacketConn
+	v6        *ipv6.PacketConn
+	readMsgs  []ipv4.Message
+	writeMsgs []ipv4.Message
+}
+
+func NewPacketConn(conn *net.UDPConn) *PacketConn {
+	batch := &PacketConn{
+		conn:      conn,
+		connected: conn.RemoteAddr() != nil,
+		readMsgs:  make([]ipv4.Message, Size),
+		writeMsgs: make([]ipv4.Message, Size),
+	}
+	for index := range batch.readMsgs {
+		batch.readMsgs[index].Buffers = make([][]byte, 1)
+		batch.writeMsgs[index].Buffers = make([][]byte, 1)
+	}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		batch.v4 = ipv4.NewPacketConn(conn)
+	} else {
+		batch.v6 = ipv6.NewPacketConn(conn)
+	}
+	return batch
+}
+
+// Read datagrams to messages buffers, block until one datagram, return messages filled.
+// Only one goroutine can read.
+func (batch *PacketConn) ReadBatch(ms []Message) (int, error) {
+	msgs := batch.readMsgs[:min(len(ms), len(batch.readMsgs))]
+	for index := range msgs {
+		msgs[index].Buffers[0] = ms[index].Buffer
+	}
+
+	var n int
+	var err error
+	if batch.v4 != nil {
+		n, err = batch.v4.ReadBatch(msgs, 0)
+	} else {
+		n, err = batch.v6.ReadBatch(msgs, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for index := range msgs[:n] {
+		ms[index].N = msgs[index].N
+		if addr, ok := msgs[index].Addr.(*net.UDPAddr); ok {
+			ap := addr.AddrPort()
+			ms[index].Addr = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()) // IPv4 in dual-stack socket is mapped
+		} else {
+			ms[index].Addr = netip.AddrPort{}
+		}
+	}
+	return n, nil
+}
+
+// Write messages, return messages written before error. Only one goroutine can write.
+func (batch *PacketConn) WriteBatch(ms []Message) (int, error) {
+	msgs := batch.writeMsgs[:min(len(ms), len(batch.writeMsgs))]
+	for index := range msgs {
+		msgs[index].Buffers[0] = ms[index].Buffer
+		msgs[index].Addr = nil
+		if !batch.connected {
+			msgs[index].Addr = net.UDPAddrFromAddrPort(ms[index].Addr)
+		}
+	}
+	var n int
+	var err error
+	if batch.v4 != nil {
+		n, err = batch.v4.WriteBatch(msgs, 0)
+	} else {
+		n, err = batch.v6.WriteBatch(msgs, 0)
+	}
+	return max(n, 0), err // Syscall error return -1
+}
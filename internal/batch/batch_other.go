@@ -0,0 +1,47 @@
+//go:build !linux
+
+package batch
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Reads and writes to UDP socket, one datagram per syscall in this system
+type PacketConn struct {
+	conn      *net.UDPConn
+	connected bool // Socket with remote address, write without destination
+}
+
+func NewPacketConn(conn *net.UDPConn) *PacketConn {
+	return &PacketConn{conn: conn, connected: conn.RemoteAddr() != nil}
+}
+
+// Read one datagram to first message, return messages filled
+func (batch *PacketConn) ReadBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	n, addr, err := batch.conn.ReadFromUDPAddrPort(ms[0].Buffer)
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()) // IPv4 in dual-stack socket is mapped
+	return 1, nil
+}
+
+// Write messages one by one, return messages written before error
+func (batch *PacketConn) WriteBatch(ms []Message) (int, error) {
+	for index, msg := range ms {
+		var err error
+		if batch.connected {
+			_, err = batch.conn.Write(msg.Buffer)
+		} else {
+			_, err = batch.conn.WriteToUDPAddrPort(msg.Buffer, msg.Addr)
+		}
+		if err != nil {
+			return index, err
+		}
+	}
+	return len(ms), nil
+}
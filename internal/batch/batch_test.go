@@ -0,0 +1,125 @@
+package batch
+
+import (
+	"net"
+	"testing"
+)
+
+const benchDatagram = 100 // Small Minecraft packet
+
+// Loopback sockets, conn send to peer
+func loopback(b *testing.B) (conn, peer *net.UDPConn) {
+	var err error
+	if conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		b.Fatal(err)
+	} else if peer, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		conn.Close()
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return
+}
+
+func reportPPS(b *testing.B) {
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+// Datagrams queued to reader before timed reads, fit default socket receive buffer
+const benchQueued = 128
+
+// Queue datagrams in conn receive buffer with timer stopped, loopback deliver in write
+func fill(b *testing.B, sender *PacketConn, msgs []Message, count int) {
+	b.StopTimer()
+	defer b.StartTimer()
+	for sent := 0; sent < count; {
+		n, err := sender.WriteBatch(msgs[:min(len(msgs), count-sent)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		sent += n
+	}
+}
+
+// Batched writer from conn to datagrams to socket to
+func sender(conn, to *net.UDPConn) (*PacketConn, []Message) {
+	msgs := make([]Message, Size)
+	for index := range msgs {
+		msgs[index] = Message{Buffer: make([]byte, benchDatagram), Addr: to.LocalAddr().(*net.UDPAddr).AddrPort()}
+	}
+	return NewPacketConn(conn), msgs
+}
+
+func BenchmarkWrite(b *testing.B) {
+	b.Run("batch", func(b *testing.B) {
+		conn, peer := loopback(b)
+		batch, msgs := sender(conn, peer)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for sent := 0; sent < b.N; {
+			n, err := batch.WriteBatch(msgs[:min(Size, b.N-sent)])
+			if err != nil {
+				b.Fatal(err)
+			}
+			sent += n
+		}
+		reportPPS(b)
+	})
+	b.Run("datagram", func(b *testing.B) {
+		conn, peer := loopback(b)
+		datagram, to := make([]byte, benchDatagram), peer.LocalAddr().(*net.UDPAddr).AddrPort()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.WriteToUDPAddrPort(datagram, to); err != nil {
+				b.Fatal(err)
+			}
+		}
+		reportPPS(b)
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+	b.Run("batch", func(b *testing.B) {
+		conn, peer := loopback(b)
+		flood, floodMsgs := sender(peer, conn)
+		batch, msgs := NewPacketConn(conn), make([]Message, Size)
+		for index := range msgs {
+			msgs[index].Buffer = make([]byte, benchDatagram)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for read := 0; read < b.N; {
+			queued := min(benchQueued, b.N-read)
+			fill(b, flood, floodMsgs, queued)
+			for queued > 0 {
+				n, err := batch.ReadBatch(msgs[:min(Size, queued)])
+				if err != nil {
+					b.Fatal(err)
+				}
+				read, queued = read+n, queued-n
+			}
+		}
+		reportPPS(b)
+	})
+	b.Run("datagram", func(b *testing.B) {
+		conn, peer := loopback(b)
+		flood, floodMsgs := sender(peer, conn)
+		datagram := make([]byte, benchDatagram)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for read := 0; read < b.N; {
+			queued := min(benchQueued, b.N-read)
+			fill(b, flood, floodMsgs, queued)
+			for ; queued > 0; queued-- {
+				if _, _, err := conn.ReadFromUDPAddrPort(datagram); err != nil {
+					b.Fatal(err)
+				}
+				read++
+			}
+		}
+		reportPPS(b)
+	})
+}
@@ -1,3 +1,5 @@
+// Big-endian encode and decode without reflection, values are appended to
+// buffers and decoded from bytes so frames not allocate to each field.
 package bigendian
 
 import (
@@ -5,81 +7,83 @@ import (
 	"io"
 )
 
-func readStream[T any](r io.Reader) (data T, err error) {
-	err = binary.Read(r, binary.BigEndian, &data)
-	return
+func AppendUint8(b []byte, value uint8) []byte {
+	return append(b, value)
 }
-func writeStream[T any](w io.Writer, data T) error {
-	return binary.Write(w, binary.BigEndian, data)
+func AppendUint16(b []byte, value uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, value)
 }
-
-func WriteBytes[T any](w io.Writer, value T) error {
-	return binary.Write(w, binary.BigEndian, value)
+func AppendUint32(b []byte, value uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, value)
 }
-func ReaderBytes[T any](r io.Reader, value T, Size uint64) error {
-	return binary.Read(r, binary.BigEndian, value)
+func AppendUint64(b []byte, value uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, value)
 }
-
-func ReadBytesN(r io.Reader, Size uint64) ([]byte, error) {
-	buff := make([]byte, Size)
-	if err := binary.Read(r, binary.BigEndian, buff); err != nil {
-		return nil, err
-	}
-	return buff, nil
+func AppendInt64(b []byte, value int64) []byte {
+	return binary.BigEndian.AppendUint64(b, uint64(value))
 }
 
-func ReadInt8(r io.Reader) (int8, error) {
-	return readStream[int8](r)
-}
-func WriteInt8(w io.Writer, value int8) error {
-	return writeStream[int8](w, value)
+// Decode values from bytes, slices returned are part of bytes not copy
+type Reader struct {
+	buff []byte
 }
 
-func ReadInt16(r io.Reader) (int16, error) {
-	return readStream[int16](r)
-}
-func WriteInt16(w io.Writer, value int16) error {
-	return writeStream[int16](w, value)
+func NewReader(b []byte) Reader {
+	return Reader{buff: b}
 }
 
-func ReadInt32(r io.Reader) (int32, error) {
-	return readStream[int32](r)
-}
-func WriteInt32(w io.Writer, value int32) error {
-	return writeStream[int32](w, value)
+// Bytes not decoded
+func (r *Reader) Len() int {
+	return len(r.buff)
 }
 
-func ReadInt64(r io.Reader) (int64, error) {
-	return readStream[int64](r)
-}
-func WriteInt64(w io.Writer, value int64) error {
-	return writeStream[int64](w, value)
+// Next n bytes, io.ErrUnexpectedEOF if bytes end before n
+func (r *Reader) Bytes(n uint64) ([]byte, error) {
+	if uint64(len(r.buff)) < n {
+		r.buff = r.buff[len(r.buff):]
+		return nil, io.ErrUnexpectedEOF
+	}
+	value := r.buff[:n:n]
+	r.buff = r.buff[n:]
+	return value, nil
 }
 
-func ReadUint8(r io.Reader) (uint8, error) {
-	return readStream[uint8](r)
-}
-func WriteUint8(w io.Writer, value uint8) error {
-	return writeStream[uint8](w, value)
+// Copy next len(value) bytes to value
+func (r *Reader) ReadFull(value []byte) error {
+	buff, err := r.Bytes(uint64(len(value)))
+	copy(value, buff)
+	return err
 }
 
-func ReadUint16(r io.Reader) (uint16, error) {
-	return readStream[uint16](r)
-}
-func WriteUint16(w io.Writer, value uint16) error {
-	return writeStream[uint16](w, value)
+func (r *Reader) Uint8() (uint8, error) {
+	buff, err := r.Bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return buff[0], nil
 }
-
-func ReadUint32(r io.Reader) (uint32, error) {
-	return readStream[uint32](r)
+func (r *Reader) Uint16() (uint16, error) {
+	buff, err := r.Bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buff), nil
 }
-func WriteUint32(w io.Writer, value uint32) error {
-	return writeStream[uint32](w, value)
+func (r *Reader) Uint32() (uint32, error) {
+	buff, err := r.Bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buff), nil
 }
-
-func ReadUint64(r io.Reader) (uint64, error) {
-	return readStream[uint64](r)
+func (r *Reader) Uint64() (uint64, error) {
+	buff, err := r.Bytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buff), nil
 }
-func WriteUint64(w io.Writer, value uint64) error {
-	return writeStream[uint64](w, value)
+func (r *Reader) Int64() (int64, error) {
+	value, err := r.Uint64()
+	return int64(value), err
 }
@@ -0,0 +1,25 @@
+// Packet buffers reused between frames and datagrams, so each packet not allocate a new buffer.
+package buffer
+
+import "sync"
+
+const Size int = 0x10000 + 0x100 // Fit any UDP datagram and frame with header
+
+var pool = sync.Pool{New: func() any {
+	buff := make([]byte, Size)
+	return &buff
+}}
+
+// Get buffer with len Size, return with Put after last use
+func Get() *[]byte {
+	return pool.Get().(*[]byte)
+}
+
+// Return buffer to pool, buffer cannot be used after Put
+func Put(buff *[]byte) {
+	if cap(*buff) < Size {
+		return // Not from pool
+	}
+	*buff = (*buff)[:Size]
+	pool.Put(buff)
+}
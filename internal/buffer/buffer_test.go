@@ -0,0 +1,32 @@
+package buffer
+
+import "testing"
+
+var sink []byte
+
+func BenchmarkPool(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buff := Get()
+		sink = (*buff)[:1]
+		Put(buff)
+	}
+}
+
+// Buffer per packet, without pool
+func BenchmarkMake(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = make([]byte, Size)
+	}
+}
+
+func TestPutForeign(t *testing.T) {
+	small := make([]byte, 10)
+	Put(&small)
+	for range 10 {
+		if buff := Get(); len(*buff) != Size {
+			t.Fatalf("pool return buffer with len %d", len(*buff))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package congestion
+
+import "time"
+
+const (
+	bbrStartupGain  float64 = 2.89 // 2/ln(2), double delivery rate each round
+	bbrCwndGain     float64 = 2    // cwnd to bandwidth delay product after startup
+	bbrBwRounds     int     = 10   // Rounds in max bandwidth filter
+	bbrFullBwRounds int     = 3    // Rounds without 25% growth to leave startup
+	bbrMinWindow    int     = 4    // cwnd floor, keep acks coming
+)
+
+// Simplified BBR, cwnd follow estimated bottleneck bandwidth times min RTT, loss is not congestion signal
+type BBR struct {
+	rttStats
+	max, cwnd int
+
+	startup    bool
+	fullBw     float64 // Bandwidth at last 25% growth in startup
+	fullRounds int
+
+	roundStart     time.Time
+	roundDelivered int
+	bwSamples      []float64 // Delivery rate per round, segments per second
+	btlBw          float64
+}
+
+func NewBBR(max int) *BBR {
+	return &BBR{max: max, cwnd: min(InitialWindow, max), startup: true}
+}
+
+func (bbr *BBR) Window() int {
+	return bbr.cwnd
+}
+
+func (bbr *BBR) OnAck(acked int, rtt time.Duration) {
+	bbr.acked += uint64(acked)
+	bbr.sample(rtt)
+	if bbr.roundStart.IsZero() {
+		bbr.roundStart = now()
+	}
+	bbr.roundDelivered += acked
+
+	// Round is one min RTT, without sample wait 10ms
+	elapsed := now().Sub(bbr.roundStart)
+	if elapsed < max(bbr.minRTT, 10*time.Millisecond) {
+		if bbr.startup {
+			bbr.cwnd = min(bbr.cwnd+acked, bbr.max) // Grow like slow start until first estimate
+		}
+		return
+	}
+	bbr.endRound(float64(bbr.roundDelivered) / elapsed.Seconds())
+	bbr.roundStart, bbr.roundDelivered = now(), 0
+}
+
+func (bbr *BBR) endRound(rate float64) {
+	if bbr.bwSamples = append(bbr.bwSamples, rate); len(bbr.bwSamples) > bbrBwRounds {
+		bbr.bwSamples = bbr.bwSamples[1:]
+	}
+	bbr.btlBw = 0
+	for _, sample := range bbr.bwSamples {
+		bbr.btlBw = max(bbr.btlBw, sample)
+	}
+
+	gain := bbrCwndGain
+	if bbr.startup {
+		gain = bbrStartupGain
+		if bbr.btlBw >= bbr.fullBw*1.25 {
+			bbr.fullBw, bbr.fullRounds = bbr.btlBw, 0
+		} else if bbr.fullRounds++; bbr.fullRounds >= bbrFullBwRounds {
+			bbr.startup = false // Pipe is full
+		}
+	}
+	bdp := bbr.btlBw * max(bbr.minRTT, 10*time.Millisecond).Seconds()
+	bbr.cwnd = min(max(int(gain*bdp), bbrMinWindow), bbr.max)
+}
+
+// Loss not change cwnd, bandwidth estimate already reflect bottleneck
+func (bbr *BBR) OnLoss() {
+	bbr.losses++
+}
+
+// Timeout mean path changed or acks lost, restart estimate
+func (bbr *BBR) OnTimeout() {
+	bbr.timeouts++
+	bbr.cwnd = min(bbrMinWindow, bbr.max)
+	bbr.roundStart, bbr.roundDelivered = time.Time{}, 0
+}
+
+func (bbr *BBR) Stats() Stats {
+	return Stats{
+		Name:     NameBBR,
+		Cwnd:     bbr.cwnd,
+		BtlBw:    bbr.btlBw,
+		SRTT:     bbr.srtt,
+		MinRTT:   bbr.minRTT,
+		Acked:    bbr.acked,
+		Losses:   bbr.losses,
+		Timeouts: bbr.timeouts,
+	}
+}
@@ -0,0 +1,73 @@
+// Congestion control to reliable streams, controller limit segments in flight from ACK and RTT samples.
+// Controllers are not safe to concurrent use, stream call controller with own lock.
+package congestion
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	NameNewReno string = "newreno" // Loss based, RFC 5681 and RFC 6582
+	NameBBR     string = "bbr"     // Bandwidth and RTT based
+
+	InitialWindow int = 10 // Segments in flight before first ACK, RFC 6928
+	MinWindow     int = 2  // Lower bound to cwnd after loss
+)
+
+var ErrInvalidName error = errors.New("invalid congestion controller, use newreno or bbr")
+
+type Stats struct {
+	Name     string        // Controller name
+	Cwnd     int           // Segments allowed in flight
+	SSThresh int           // Slow start threshold (NewReno)
+	BtlBw    float64       // Estimated bottleneck bandwidth in segments per second (BBR)
+	SRTT     time.Duration // Smoothed RTT
+	MinRTT   time.Duration // Min RTT sample
+	Acked    uint64        // Segments acknowledged
+	Losses   uint64        // Loss events detected by duplicated acks
+	Timeouts uint64        // Retransmission timeouts
+}
+
+type Controller interface {
+	Window() int                        // Segments allowed in flight
+	OnAck(acked int, rtt time.Duration) // New segments acknowledged, rtt is zero if not sampled
+	OnLoss()                            // Loss detected by fast retransmit, once per recovery
+	OnTimeout()                         // Retransmission timeout
+	Stats() Stats                       // Current state
+}
+
+// Create controller by name, max limit window size
+func New(name string, max int) (Controller, error) {
+	switch name {
+	case "", NameNewReno:
+		return NewNewReno(max), nil
+	case NameBBR:
+		return NewBBR(max), nil
+	}
+	return nil, ErrInvalidName
+}
+
+// Common RTT and counters to controllers
+type rttStats struct {
+	srtt, minRTT            time.Duration
+	minRTTAt                time.Time
+	acked, losses, timeouts uint64
+}
+
+const minRTTWindow time.Duration = 10 * time.Second // Min RTT expire, path can change
+
+var now = time.Now // Clock to rounds and min RTT expire, replaced by simulated clock in tests
+
+func (stats *rttStats) sample(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	} else if stats.srtt == 0 {
+		stats.srtt = rtt
+	} else {
+		stats.srtt = (7*stats.srtt + rtt) / 8
+	}
+	if stats.minRTT == 0 || rtt <= stats.minRTT || now().Sub(stats.minRTTAt) > minRTTWindow {
+		stats.minRTT, stats.minRTTAt = rtt, now()
+	}
+}
@@ -0,0 +1,247 @@
+package congestion_test
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/congestion"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/reliable"
+)
+
+// One direction of simulated link, segments wait bottleneck queue, propagation delay and are dropped randomly
+type link struct {
+	delay time.Duration // One-way propagation delay
+	rate  float64       // Bottleneck rate in segments per second, zero is unlimited
+	queue int           // Segments waiting bottleneck before drop-tail
+	loss  float64       // Random drop probability
+
+	mu        sync.Mutex
+	random    *rand.Rand
+	busyUntil time.Time // Bottleneck send last segment queued
+	dropped   int
+}
+
+func newLink(delay time.Duration, rate float64, queue int, loss float64, seed int64) *link {
+	return &link{delay: delay, rate: rate, queue: queue, loss: loss, random: rand.New(rand.NewSource(seed))}
+}
+
+// Call deliver after segment cross link, or never if segment is dropped
+func (link *link) send(deliver func()) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	now := time.Now()
+	at := now
+	if link.rate > 0 {
+		serialize := time.Duration(float64(time.Second) / link.rate)
+		start := now
+		if link.busyUntil.After(now) {
+			start = link.busyUntil
+		}
+		if waiting := int(start.Sub(now) / serialize); waiting >= link.queue {
+			link.dropped++ // Queue full
+			return
+		}
+		link.busyUntil = start.Add(serialize)
+		at = link.busyUntil
+	}
+	if link.random.Float64() < link.loss {
+		link.dropped++
+		return
+	}
+	time.AfterFunc(at.Add(link.delay).Sub(now), deliver)
+}
+
+func skipShort(t *testing.T) {
+	if testing.Short() {
+		t.Skip("link simulator run in real time")
+	}
+}
+
+type transfer struct {
+	stats   congestion.Stats
+	elapsed time.Duration
+	dropped int
+}
+
+// Send segments from stream with controller to other stream over forward and back links, fail if data is lost or reordered
+func simulate(t *testing.T, cc congestion.Controller, forward, back *link, segments int) transfer {
+	skipShort(t)
+	var mu sync.Mutex
+	var next uint64
+	var sender, receiver *reliable.Stream
+	sender = reliable.NewStreamCongestion(cc, func(seq uint64, data []byte) error {
+		forward.send(func() { receiver.Receive(seq, data) })
+		return nil
+	}, func(ack uint64) error { return nil }, func(data []byte) error { return nil })
+	receiver = reliable.NewStream(func(seq uint64, data []byte) error { return nil }, func(ack uint64) error {
+		back.send(func() { sender.Ack(ack) })
+		return nil
+	}, func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if index := binary.BigEndian.Uint64(data); index != next {
+			t.Errorf("segment %d delivered, expected %d", index, next)
+		}
+		next++
+		return nil
+	})
+	defer sender.Close()
+	defer receiver.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	start, payload := time.Now(), make([]byte, 1000)
+	for index := 0; index < segments && ctx.Err() == nil; index++ {
+		binary.BigEndian.PutUint64(payload, uint64(index))
+		if _, err := sender.Write(payload); err != nil {
+			t.Fatalf("write segment %d: %s", index, err)
+		}
+	}
+	if err := sender.Flush(ctx); err != nil {
+		t.Fatalf("flush: %s, %+v", err, sender.Congestion())
+	}
+	elapsed := time.Since(start)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if next != uint64(segments) {
+		t.Fatalf("%d of %d segments delivered", next, segments)
+	}
+	forward.mu.Lock()
+	defer forward.mu.Unlock()
+	result := transfer{stats: sender.Congestion(), elapsed: elapsed, dropped: forward.dropped}
+	t.Logf("%s: %d segments in %s, %d dropped, %+v", result.stats.Name, segments, result.elapsed, result.dropped, result.stats)
+	if result.stats.Acked != uint64(segments) {
+		t.Errorf("%d segments acked, %d sent", result.stats.Acked, segments)
+	} else if result.stats.Cwnd < 1 || result.stats.Cwnd > reliable.Window {
+		t.Errorf("cwnd %d outside 1..%d", result.stats.Cwnd, reliable.Window)
+	} else if rtt := 2 * forward.delay; result.stats.MinRTT < rtt || result.stats.MinRTT > rtt+rtt/2 {
+		t.Errorf("min RTT %s, link RTT %s", result.stats.MinRTT, rtt)
+	}
+	return result
+}
+
+const (
+	linkDelay    = 25 * time.Millisecond // 50ms RTT, residential link
+	linkRate     = 1000                  // Segments per second, about 8Mbit/s
+	linkQueue    = 50                    // Segments buffered in bottleneck, one BDP
+	linkLoss     = 0.02                  // Random loss, wifi and mobile links
+	linkAckLoss  = 0.01                  // Acks lost on return path
+	linkSegments = 1000
+)
+
+// Bottleneck with drop-tail queue and random loss in both directions
+func lossyLink(seed int64) (forward, back *link) {
+	return newLink(linkDelay, linkRate, linkQueue, linkLoss, seed), newLink(linkDelay, 0, 0, linkAckLoss, seed+1)
+}
+
+func TestNewRenoLossyLink(t *testing.T) {
+	t.Parallel()
+	forward, back := lossyLink(1)
+	result := simulate(t, congestion.NewNewReno(reliable.Window), forward, back, linkSegments)
+	if result.dropped == 0 {
+		t.Fatal("link not dropped segments")
+	} else if result.stats.Losses+result.stats.Timeouts == 0 {
+		t.Error("loss not detected")
+	} else if result.stats.SSThresh >= reliable.Window {
+		t.Errorf("ssthresh %d not reduced after loss", result.stats.SSThresh)
+	}
+}
+
+func TestBBRLossyLink(t *testing.T) {
+	t.Parallel()
+	forward, back := lossyLink(1)
+	result := simulate(t, congestion.NewBBR(reliable.Window), forward, back, linkSegments)
+	if result.dropped == 0 {
+		t.Fatal("link not dropped segments")
+	} else if result.stats.Losses+result.stats.Timeouts == 0 {
+		t.Error("loss not detected")
+	} else if result.stats.BtlBw <= 0 {
+		t.Error("bandwidth not estimated")
+	}
+}
+
+// Without loss BBR must find bottleneck rate and keep cwnd near bandwidth delay product
+func TestBBRBandwidthEstimate(t *testing.T) {
+	t.Parallel()
+	result := simulate(t, congestion.NewBBR(reliable.Window),
+		newLink(linkDelay, linkRate, 4*linkQueue, 0, 1), newLink(linkDelay, 0, 0, 0, 2), linkSegments)
+	bdp := linkRate * (2 * linkDelay).Seconds()
+	if result.stats.BtlBw < linkRate/2 || result.stats.BtlBw > linkRate*3/2 {
+		t.Errorf("bandwidth estimate %.0f segments/s, link rate %d segments/s", result.stats.BtlBw, linkRate)
+	} else if float64(result.stats.Cwnd) > 3*bdp {
+		t.Errorf("cwnd %d far above bandwidth delay product %.0f", result.stats.Cwnd, bdp)
+	}
+}
+
+// Send cwnd segments each simulated RTT, segments above capacity are dropped and others lost with random.
+// Loss is reported once per round like fast recovery, return segments delivered per round
+func rounds(cc congestion.Controller, capacity int, loss float64, count int) []int {
+	clock, random := time.Unix(0, 0), rand.New(rand.NewSource(1))
+	defer congestion.SetClock(func() time.Time { return clock })()
+
+	delivered := make([]int, count)
+	for round := range delivered {
+		sent := cc.Window()
+		for index := 0; index < min(sent, capacity); index++ {
+			if random.Float64() >= loss {
+				delivered[round]++
+			}
+		}
+		clock = clock.Add(2 * linkDelay)
+		if delivered[round] < sent {
+			cc.OnLoss()
+		}
+		cc.OnAck(delivered[round], 2*linkDelay)
+	}
+	return delivered
+}
+
+func average(values []int) float64 {
+	var sum int
+	for _, value := range values {
+		sum += value
+	}
+	return float64(sum) / float64(len(values))
+}
+
+// Random loss is congestion to NewReno but not to BBR, BBR must deliver more segments per RTT on same link
+func TestRandomLossThroughput(t *testing.T) {
+	const count, capacity = 200, 2 * linkQueue // Bandwidth delay product and bottleneck queue
+	newreno := rounds(congestion.NewNewReno(reliable.Window), capacity, linkLoss, count)
+	bbr := rounds(congestion.NewBBR(reliable.Window), capacity, linkLoss, count)
+
+	// Skip startup rounds
+	newrenoRate, bbrRate := average(newreno[count/2:]), average(bbr[count/2:])
+	t.Logf("segments per RTT: newreno %.1f, bbr %.1f, capacity %d", newrenoRate, bbrRate, capacity)
+	if bbrRate < capacity*(1-2*linkLoss) {
+		t.Errorf("bbr delivered %.1f segments per RTT, capacity %d", bbrRate, capacity)
+	} else if newrenoRate >= bbrRate {
+		t.Errorf("newreno delivered %.1f segments per RTT, bbr %.1f", newrenoRate, bbrRate)
+	}
+}
+
+// NewReno halve cwnd on loss and BBR keep cwnd from bandwidth estimate
+func TestCwndAfterLoss(t *testing.T) {
+	newreno := congestion.NewNewReno(reliable.Window)
+	rounds(newreno, reliable.Window, 0, 3)
+	before := newreno.Window()
+	newreno.OnLoss()
+	if cwnd := newreno.Window(); cwnd != before/2 {
+		t.Errorf("newreno cwnd %d after loss, %d before", cwnd, before)
+	}
+
+	bbr := congestion.NewBBR(reliable.Window)
+	rounds(bbr, 2*linkQueue, 0, 20)
+	before, losses := bbr.Window(), bbr.Stats().Losses
+	bbr.OnLoss()
+	if cwnd := bbr.Window(); cwnd != before {
+		t.Errorf("bbr cwnd %d after loss, %d before", cwnd, before)
+	} else if stats := bbr.Stats(); stats.Losses != losses+1 {
+		t.Errorf("bbr loss not counted, %+v", stats)
+	}
+}
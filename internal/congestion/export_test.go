@@ -0,0 +1,10 @@
+package congestion
+
+import "time"
+
+// Replace clock of controllers, return function to restore real clock
+func SetClock(clock func() time.Time) (restore func()) {
+	old := now
+	now = clock
+	return func() { now = old }
+}
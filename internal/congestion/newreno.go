@@ -0,0 +1,57 @@
+package congestion
+
+import "time"
+
+// Slow start until loss, after additive increase and multiplicative decrease
+type NewReno struct {
+	rttStats
+	max            int
+	cwnd, ssthresh int
+	increase       int // Acked segments in congestion avoidance, cwnd grow one segment per cwnd acked
+}
+
+func NewNewReno(max int) *NewReno {
+	return &NewReno{max: max, cwnd: min(InitialWindow, max), ssthresh: max}
+}
+
+func (reno *NewReno) Window() int {
+	return reno.cwnd
+}
+
+func (reno *NewReno) OnAck(acked int, rtt time.Duration) {
+	reno.acked += uint64(acked)
+	reno.sample(rtt)
+	if reno.cwnd < reno.ssthresh {
+		reno.cwnd = min(reno.cwnd+acked, reno.max) // Slow start
+		return
+	}
+	if reno.increase += acked; reno.increase >= reno.cwnd {
+		reno.increase -= reno.cwnd
+		reno.cwnd = min(reno.cwnd+1, reno.max)
+	}
+}
+
+func (reno *NewReno) OnLoss() {
+	reno.losses++
+	reno.ssthresh = max(reno.cwnd/2, MinWindow)
+	reno.cwnd, reno.increase = reno.ssthresh, 0
+}
+
+func (reno *NewReno) OnTimeout() {
+	reno.timeouts++
+	reno.ssthresh = max(reno.cwnd/2, MinWindow)
+	reno.cwnd, reno.increase = 1, 0
+}
+
+func (reno *NewReno) Stats() Stats {
+	return Stats{
+		Name:     NameNewReno,
+		Cwnd:     reno.cwnd,
+		SSThresh: reno.ssthresh,
+		SRTT:     reno.srtt,
+		MinRTT:   reno.minRTT,
+		Acked:    reno.acked,
+		Losses:   reno.losses,
+		Timeouts: reno.timeouts,
+	}
+}
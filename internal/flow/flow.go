@@ -0,0 +1,127 @@
+// Credit flow control to streams, like HTTP/2 WINDOW_UPDATE.
+//
+// Receiver advertise absolute limit of bytes sender can send, limits only grow so lost,
+// duplicated or reordered updates over UDP are ignored. Blocked sender probe receiver
+// to get current limit if last update is lost.
+package flow
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed error = errors.New("flow window closed")
+
+	ProbeInterval time.Duration = time.Second // Time blocked before request current limit
+)
+
+// Sender credit
+type Send struct {
+	mu          sync.Mutex
+	sent, limit uint64
+	update      chan struct{} // Limit updated
+	done        chan struct{} // Closed on Close
+	closeOnce   sync.Once
+	probe       func(limit uint64) error // Request current limit to receiver
+}
+
+// Create sender with initial limit
+func NewSend(initial uint64, probe func(limit uint64) error) *Send {
+	return &Send{
+		limit:  initial,
+		update: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		probe:  probe,
+	}
+}
+
+// Take credit up to n bytes, block until receiver open window
+func (send *Send) Acquire(n int) (int, error) {
+	for {
+		send.mu.Lock()
+		if send.sent < send.limit {
+			n = int(min(uint64(n), send.limit-send.sent))
+			send.sent += uint64(n)
+			send.mu.Unlock()
+			return n, nil
+		}
+		limit := send.limit
+		send.mu.Unlock()
+
+		select {
+		case <-send.update:
+		case <-send.done:
+			return 0, ErrClosed
+		case <-time.After(ProbeInterval):
+			send.probe(limit)
+		}
+	}
+}
+
+// Receiver advertised new limit, old limits are ignored
+func (send *Send) Update(limit uint64) {
+	send.mu.Lock()
+	defer send.mu.Unlock()
+	if limit > send.limit {
+		send.limit = limit
+		select {
+		case send.update <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Bytes can be sent without block
+func (send *Send) Credit() uint64 {
+	send.mu.Lock()
+	defer send.mu.Unlock()
+	return send.limit - send.sent
+}
+
+// Release blocked writers
+func (send *Send) Close() error {
+	send.closeOnce.Do(func() { close(send.done) })
+	return nil
+}
+
+// Receiver consumed bytes and advertised limit
+type Recv struct {
+	mu              sync.Mutex
+	consumed, limit uint64
+	window          uint64
+	update          func(limit uint64) error // Send limit to sender
+}
+
+// Create receiver with window size, if window is bigger than initial limit sender is notified
+func NewRecv(initial, window uint64, update func(limit uint64) error) *Recv {
+	recv := &Recv{limit: initial, window: window, update: update}
+	if window > initial {
+		recv.limit = window
+		update(recv.limit)
+	}
+	return recv
+}
+
+// Data written to client, advertise new limit when half window is consumed
+func (recv *Recv) Consume(n int) {
+	recv.mu.Lock()
+	recv.consumed += uint64(n)
+	if recv.consumed+recv.window < recv.limit+recv.window/2 {
+		recv.mu.Unlock()
+		return
+	}
+	recv.limit = recv.consumed + recv.window
+	limit := recv.limit
+	recv.mu.Unlock()
+	recv.update(limit)
+}
+
+// Resend current limit, reply to sender probe
+func (recv *Recv) Advertise() error {
+	recv.mu.Lock()
+	limit := recv.limit
+	recv.mu.Unlock()
+	return recv.update(limit)
+}
@@ -0,0 +1,128 @@
+// Split ClientData bigger than datagram size in fragments and reassemble fragments in other side
+package fragment
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
+)
+
+var (
+	ErrTooBig error = errors.New("data bigger than max data size")
+
+	Timeout    time.Duration = time.Second * 5 // Drop data without all fragments in this time
+	MaxPending int           = 256             // Data waiting fragments, oldest is dropped when full
+)
+
+// Split data in fragments with data up to size bytes, data smaller than size is not fragmented
+func Split(data proto.ClientData, size int, id uint32) ([]proto.ClientData, error) {
+	if uint64(len(data.Data)) > proto.MaxDataSize {
+		return nil, ErrTooBig
+	} else if len(data.Data) <= size {
+		return []proto.ClientData{data}, nil
+	}
+
+	count := (len(data.Data) + size - 1) / size
+	if count > int(proto.MaxFragments) {
+		return nil, ErrTooBig
+	}
+	fragments := make([]proto.ClientData, count)
+	for index := range fragments {
+		part := data.Data[index*size : min((index+1)*size, len(data.Data))]
+		fragments[index] = proto.ClientData{
+			Client:   data.Client,
+			Seq:      data.Seq,
+			Fragment: proto.Fragment{ID: id, Index: uint8(index), Count: uint8(count)},
+			Size:     uint64(len(part)),
+			Data:     part,
+		}
+	}
+	return fragments, nil
+}
+
+type key struct {
+	client string
+	id     uint32
+}
+
+type pending struct {
+	parts   [][]byte
+	missing int
+	size    uint64
+	created time.Time
+}
+
+// Fragments waiting reassembly from one sender
+type Reassembler struct {
+	mu      sync.Mutex
+	pending map[key]*pending
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{pending: make(map[key]*pending)}
+}
+
+// Add fragment, return data reassembled when all fragments recived or nil if waiting fragments
+func (reassembler *Reassembler) Add(data *proto.ClientData) *proto.ClientData {
+	if data.Fragment.Count <= 1 {
+		return data
+	} else if data.Fragment.Count > proto.MaxFragments || data.Fragment.Index >= data.Fragment.Count {
+		return nil // Invalid fragment, decoder already reject it from network
+	}
+	reassembler.mu.Lock()
+	defer reassembler.mu.Unlock()
+
+	id := key{data.Client.Key(), data.Fragment.ID}
+	frag, ok := reassembler.pending[id]
+	if !ok || len(frag.parts) != int(data.Fragment.Count) || time.Since(frag.created) > Timeout {
+		reassembler.expire()
+		frag = &pending{parts: make([][]byte, data.Fragment.Count), missing: int(data.Fragment.Count), created: time.Now()}
+		reassembler.pending[id] = frag
+	}
+	if frag.parts[data.Fragment.Index] != nil {
+		return nil // Duplicated fragment
+	} else if frag.size += data.Size; frag.size > proto.MaxDataSize {
+		delete(reassembler.pending, id)
+		return nil
+	}
+	frag.parts[data.Fragment.Index] = data.Data
+	if frag.missing--; frag.missing > 0 {
+		return nil
+	}
+
+	delete(reassembler.pending, id)
+	full := make([]byte, 0, frag.size)
+	for _, part := range frag.parts {
+		full = append(full, part...)
+	}
+	return &proto.ClientData{Client: data.Client, Seq: data.Seq, Size: frag.size, Data: full}
+}
+
+// Drop data without all fragments in timeout and oldest if full, caller must hold lock
+func (reassembler *Reassembler) expire() {
+	var oldest key
+	var oldestTime time.Time
+	for id, frag := range reassembler.pending {
+		if time.Since(frag.created) > Timeout {
+			delete(reassembler.pending, id)
+		} else if oldestTime.IsZero() || frag.created.Before(oldestTime) {
+			oldest, oldestTime = id, frag.created
+		}
+	}
+	if len(reassembler.pending) >= MaxPending {
+		delete(reassembler.pending, oldest)
+	}
+}
+
+// Drop fragments waiting from client
+func (reassembler *Reassembler) Delete(client proto.Client) {
+	reassembler.mu.Lock()
+	defer reassembler.mu.Unlock()
+	for id := range reassembler.pending {
+		if id.client == client.Key() {
+			delete(reassembler.pending, id)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package fragment
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
+)
+
+var client = proto.Client{Client: netip.MustParseAddrPort("127.0.0.1:25565"), Proto: proto.ProtoUDP, Mapping: 1}
+
+// Data with byte index in each position, wrong fragment order change data
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for index := range data {
+		data[index] = byte(index / 7)
+	}
+	return data
+}
+
+func split(t *testing.T, size, fragment int) (proto.ClientData, []proto.ClientData) {
+	data := proto.ClientData{Client: client, Seq: 9, Size: uint64(size), Data: testData(size)}
+	fragments, err := Split(data, fragment, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, fragments
+}
+
+func reassembled(t *testing.T, data proto.ClientData, full *proto.ClientData) {
+	if full == nil {
+		t.Fatal("data not reassembled after all fragments")
+	} else if full.Seq != data.Seq || full.Size != data.Size || full.Client != data.Client || !bytes.Equal(full.Data, data.Data) {
+		t.Fatalf("reassembled seq %d with %d bytes, expected seq %d with %d bytes", full.Seq, full.Size, data.Seq, data.Size)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	data, fragments := split(t, 5000, 1000)
+	if len(fragments) != 5 {
+		t.Fatalf("%d fragments, expected 5", len(fragments))
+	}
+	for index, frag := range fragments {
+		if frag.Fragment.Index != uint8(index) || frag.Fragment.Count != 5 || frag.Seq != data.Seq {
+			t.Fatalf("fragment %d header %+v", index, frag.Fragment)
+		}
+	}
+	if _, small := split(t, 1000, 1000); len(small) != 1 || small[0].Fragment.Count != 0 {
+		t.Fatal("data fit in size is fragmented")
+	}
+}
+
+// Data need more than MaxFragments to size
+func TestSplitTooMany(t *testing.T) {
+	size := int(proto.MaxFragments)*100 + 1
+	if _, err := Split(proto.ClientData{Client: client, Data: testData(size)}, 100, 1); err != ErrTooBig {
+		t.Fatalf("split in %d fragments return %v", int(proto.MaxFragments)+1, err)
+	}
+}
+
+func TestReassembleOutOfOrder(t *testing.T) {
+	data, fragments := split(t, 5000, 1000)
+	reassembler := NewReassembler()
+	for _, index := range []int{4, 2, 0, 3} {
+		if full := reassembler.Add(&fragments[index]); full != nil {
+			t.Fatalf("data reassembled after fragment %d", index)
+		}
+	}
+	reassembled(t, data, reassembler.Add(&fragments[1]))
+}
+
+// Duplicated fragment not count as missing fragment
+func TestReassembleDuplicate(t *testing.T) {
+	data, fragments := split(t, 3000, 1000)
+	reassembler := NewReassembler()
+	for _, index := range []int{0, 0, 1, 1} {
+		if full := reassembler.Add(&fragments[index]); full != nil {
+			t.Fatalf("data reassembled with duplicated fragment %d", index)
+		}
+	}
+	reassembled(t, data, reassembler.Add(&fragments[2]))
+}
+
+// Fragments with count or index out of range are dropped
+func TestReassembleInvalid(t *testing.T) {
+	reassembler := NewReassembler()
+	for _, frag := range []proto.Fragment{
+		{ID: 1, Index: 64, Count: proto.MaxFragments + 1},
+		{ID: 2, Index: 0, Count: 255},
+		{ID: 3, Index: 3, Count: 3},
+	} {
+		if full := reassembler.Add(&proto.ClientData{Client: client, Fragment: frag, Size: 1, Data: []byte{1}}); full != nil {
+			t.Fatalf("invalid fragment %+v reassembled", frag)
+		}
+	}
+	if pending := len(reassembler.pending); pending != 0 {
+		t.Fatalf("%d invalid fragments waiting", pending)
+	}
+}
+
+// Fragments older than Timeout are dropped and data start again
+func TestReassembleTimeout(t *testing.T) {
+	defer func(old time.Duration) { Timeout = old }(Timeout)
+	Timeout = 20 * time.Millisecond
+
+	data, fragments := split(t, 2000, 1000)
+	reassembler := NewReassembler()
+	reassembler.Add(&fragments[0])
+	time.Sleep(2 * Timeout)
+	if full := reassembler.Add(&fragments[1]); full != nil {
+		t.Fatal("data reassembled with expired fragment")
+	}
+	reassembled(t, data, reassembler.Add(&fragments[0]))
+}
+
+// Oldest data is dropped when MaxPending data wait fragments
+func TestReassembleMaxPending(t *testing.T) {
+	defer func(old int) { MaxPending = old }(MaxPending)
+	MaxPending = 2
+
+	reassembler := NewReassembler()
+	var first []proto.ClientData
+	for id := uint32(1); id <= 3; id++ {
+		fragments, err := Split(proto.ClientData{Client: client, Data: testData(2000)}, 1000, id)
+		if err != nil {
+			t.Fatal(err)
+		} else if id == 1 {
+			first = fragments
+		}
+		reassembler.Add(&fragments[0])
+		time.Sleep(time.Millisecond) // Different created time
+	}
+	if full := reassembler.Add(&first[1]); full != nil {
+		t.Fatal("oldest data not dropped with pending full")
+	}
+}
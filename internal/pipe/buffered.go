@@ -0,0 +1,290 @@
+package pipe
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var DefaultCapacity int = 0x40000 // Bytes buffered in each direction if BufferConfig.Capacity is zero
+
+type BufferConfig struct {
+	Capacity int  // Bytes buffered in each direction before Write wait or drop
+	Packet   bool // One Write is one Read, datagram bigger than Read buffer is truncated
+	Drop     bool // Write not fit in buffer is dropped complete instead of wait, to datagrams
+}
+
+type Stats struct {
+	Buffered  int    // Bytes waiting remote Read
+	HighWater int    // Max bytes buffered
+	Capacity  int    // Bytes buffered before Write wait or drop
+	Dropped   uint64 // Writes dropped because buffer was full
+}
+
+// Bytes written in one end waiting read in other end
+type buffered struct {
+	mu        sync.Mutex
+	config    BufferConfig
+	data      bytes.Buffer
+	sizes     []int // Datagram sizes in data, packet mode only
+	highWater int
+	dropped   uint64
+
+	writeClosed bool // Writer closed, Read return EOF after data
+	readClosed  bool // Reader closed, Write fail and data is dropped
+	aborted     bool // Closed with reset, other end get ErrReset
+
+	readable chan struct{} // Wake reader after write or close
+	writable chan struct{} // Wake writer after read or close
+}
+
+func newBuffered(config BufferConfig) *buffered {
+	return &buffered{config: config, readable: make(chan struct{}, 1), writable: make(chan struct{}, 1)}
+}
+
+func notify(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func (buf *buffered) read(b []byte, deadline *pipeDeadline) (int, error) {
+	for {
+		buf.mu.Lock()
+		if buf.readClosed {
+			buf.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		} else if buf.aborted {
+			buf.mu.Unlock()
+			return 0, ErrReset
+		} else if isClosedChan(deadline.wait()) {
+			buf.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if buf.data.Len() > 0 || len(buf.sizes) > 0 {
+			var n int
+			if buf.config.Packet {
+				size := buf.sizes[0]
+				buf.sizes = buf.sizes[1:]
+				n, _ = buf.data.Read(b[:min(len(b), size)])
+				buf.data.Next(size - n) // Drop rest of datagram
+			} else {
+				n, _ = buf.data.Read(b)
+			}
+			if buf.data.Len() > 0 || len(buf.sizes) > 0 {
+				notify(buf.readable) // Other readers
+			}
+			buf.mu.Unlock()
+			notify(buf.writable)
+			return n, nil
+		} else if buf.writeClosed {
+			buf.mu.Unlock()
+			notify(buf.readable)
+			return 0, io.EOF
+		}
+		buf.mu.Unlock()
+
+		select {
+		case <-buf.readable:
+		case <-deadline.wait():
+		}
+	}
+}
+
+func (buf *buffered) write(b []byte, deadline *pipeDeadline) (n int, err error) {
+	for {
+		buf.mu.Lock()
+		if buf.writeClosed {
+			buf.mu.Unlock()
+			return n, io.ErrClosedPipe
+		} else if buf.readClosed {
+			err = io.ErrClosedPipe
+			if buf.aborted {
+				err = ErrReset
+			}
+			buf.mu.Unlock()
+			return n, err
+		} else if isClosedChan(deadline.wait()) {
+			buf.mu.Unlock()
+			return n, os.ErrDeadlineExceeded
+		}
+
+		if buf.config.Packet || buf.config.Drop {
+			// Write complete, buffer always accept one write bigger than capacity
+			if buf.data.Len() == 0 || buf.data.Len()+len(b) <= buf.config.Capacity {
+				buf.append(b)
+			} else if !buf.config.Drop {
+				buf.mu.Unlock()
+				select {
+				case <-buf.writable:
+				case <-deadline.wait():
+				}
+				continue
+			} else {
+				buf.dropped++
+			}
+			buf.mu.Unlock()
+			return len(b), nil
+		}
+
+		if space := buf.config.Capacity - buf.data.Len(); space > 0 {
+			size := min(space, len(b))
+			buf.append(b[:size])
+			b, n = b[size:], n+size
+		}
+		buf.mu.Unlock()
+		if len(b) == 0 {
+			return n, nil
+		}
+
+		select {
+		case <-buf.writable:
+		case <-deadline.wait():
+		}
+	}
+}
+
+// Append write to data and wake reader, caller must hold lock
+func (buf *buffered) append(b []byte) {
+	buf.data.Write(b)
+	if buf.config.Packet {
+		buf.sizes = append(buf.sizes, len(b))
+	}
+	buf.highWater = max(buf.highWater, buf.data.Len())
+	notify(buf.readable)
+}
+
+func (buf *buffered) closeWrite(abort bool) {
+	buf.mu.Lock()
+	buf.writeClosed = true
+	if abort {
+		buf.aborted = true
+		buf.data.Reset()
+		buf.sizes = nil
+	}
+	buf.mu.Unlock()
+	notify(buf.readable)
+	notify(buf.writable)
+}
+
+func (buf *buffered) closeRead(abort bool) {
+	buf.mu.Lock()
+	buf.readClosed = true
+	buf.aborted = buf.aborted || abort
+	buf.data.Reset() // Nobody read data
+	buf.sizes = nil
+	buf.mu.Unlock()
+	notify(buf.readable)
+	notify(buf.writable)
+}
+
+func (buf *buffered) stats() Stats {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return Stats{Buffered: buf.data.Len(), HighWater: buf.highWater, Capacity: buf.config.Capacity, Dropped: buf.dropped}
+}
+
+// Pipe end with buffer, Write return after copy data to buffer and
+// only wait Read when buffer is full, so slow reader not block writer.
+type BufferedConn struct {
+	localAddr, remoteAddr net.Addr
+
+	rx, tx *buffered  // Data to read in this end and data written to remote end
+	wrMu   sync.Mutex // Serialize Write operations
+
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+}
+
+// Create buffered pipe, each direction buffer config.Capacity bytes
+func CreateBufferedPipe(LocalAddress, RemoteAddress net.Addr, config BufferConfig) (*BufferedConn, *BufferedConn) {
+	if config.Capacity <= 0 {
+		config.Capacity = DefaultCapacity
+	}
+	b1, b2 := newBuffered(config), newBuffered(config)
+	p1 := &BufferedConn{
+		localAddr:     LocalAddress,
+		remoteAddr:    RemoteAddress,
+		rx:            b1,
+		tx:            b2,
+		readDeadline:  makePipeDeadline(),
+		writeDeadline: makePipeDeadline(),
+	}
+	p2 := &BufferedConn{
+		localAddr:     LocalAddress,
+		remoteAddr:    RemoteAddress,
+		rx:            b2,
+		tx:            b1,
+		readDeadline:  makePipeDeadline(),
+		writeDeadline: makePipeDeadline(),
+	}
+	return p1, p2
+}
+
+func (p *BufferedConn) LocalAddr() net.Addr  { return p.localAddr }
+func (p *BufferedConn) RemoteAddr() net.Addr { return p.remoteAddr }
+
+func (p *BufferedConn) Read(b []byte) (int, error) {
+	n, err := p.rx.read(b, &p.readDeadline)
+	if err != nil && err != io.EOF && err != io.ErrClosedPipe {
+		err = &net.OpError{Op: "read", Net: "pipe", Err: err}
+	}
+	return n, err
+}
+
+func (p *BufferedConn) Write(b []byte) (int, error) {
+	p.wrMu.Lock() // Ensure entirety of b is written together
+	defer p.wrMu.Unlock()
+	n, err := p.tx.write(b, &p.writeDeadline)
+	if err != nil && err != io.ErrClosedPipe {
+		err = &net.OpError{Op: "write", Net: "pipe", Err: err}
+	}
+	return n, err
+}
+
+func (p *BufferedConn) SetDeadline(t time.Time) error {
+	p.SetReadDeadline(t)
+	return p.SetWriteDeadline(t)
+}
+
+func (p *BufferedConn) SetReadDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	notify(p.rx.readable) // Reader wait new deadline
+	return nil
+}
+
+func (p *BufferedConn) SetWriteDeadline(t time.Time) error {
+	p.writeDeadline.set(t)
+	notify(p.tx.writable) // Writer wait new deadline
+	return nil
+}
+
+// Data written before Close is read by remote before io.EOF
+func (p *BufferedConn) Close() error {
+	p.tx.closeWrite(false)
+	p.rx.closeRead(false)
+	return nil
+}
+
+// Stop writes, remote Read return io.EOF after data buffered and remote still can write
+func (p *BufferedConn) CloseWrite() error {
+	p.tx.closeWrite(false)
+	return nil
+}
+
+// Drop data buffered and remote Read and Write return ErrReset
+func (p *BufferedConn) Abort() error {
+	p.tx.closeWrite(true)
+	p.rx.closeRead(true)
+	return nil
+}
+
+// Data written in this end waiting remote Read
+func (p *BufferedConn) Stats() Stats {
+	return p.tx.stats()
+}
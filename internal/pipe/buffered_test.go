@@ -0,0 +1,219 @@
+package pipe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25565}
+
+// Datagram of size with byte index, to check boundaries in Read
+func datagram(index, size int) []byte {
+	return bytes.Repeat([]byte{byte(index)}, size)
+}
+
+func TestPacketBoundaries(t *testing.T) {
+	const writes = 1000
+	local, remote := CreateBufferedPipe(addr, addr, BufferConfig{Capacity: 0x1000, Packet: true})
+	go func() {
+		for index := 0; index < writes; index++ {
+			local.Write(datagram(index, 1+index%300))
+		}
+	}()
+
+	buff := make([]byte, 0x1000)
+	for index := 0; index < writes; index++ {
+		n, err := remote.Read(buff)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buff[:n], datagram(index, 1+index%300)) {
+			t.Fatalf("read %d return %d bytes, expected datagram with %d bytes", index, n, 1+index%300)
+		}
+	}
+}
+
+// Rest of datagram bigger than Read buffer is dropped, not returned in next Read
+func TestPacketTruncate(t *testing.T) {
+	local, remote := CreateBufferedPipe(addr, addr, BufferConfig{Packet: true})
+	local.Write(datagram(1, 100))
+	local.Write(datagram(2, 10))
+
+	buff := make([]byte, 40)
+	if n, err := remote.Read(buff); err != nil || !bytes.Equal(buff[:n], datagram(1, 40)) {
+		t.Fatalf("first read %d bytes, %v", n, err)
+	} else if n, err = remote.Read(buff); err != nil || !bytes.Equal(buff[:n], datagram(2, 10)) {
+		t.Fatalf("second read %v, %v, expected next datagram", buff[:n], err)
+	}
+}
+
+func TestPacketDrop(t *testing.T) {
+	local, remote := CreateBufferedPipe(addr, addr, BufferConfig{Capacity: 100, Packet: true, Drop: true})
+	for index := 0; index < 3; index++ {
+		if n, err := local.Write(datagram(index, 60)); err != nil || n != 60 {
+			t.Fatalf("write %d return %d, %v", index, n, err)
+		}
+	}
+	if stats := local.Stats(); stats.Dropped != 2 || stats.Buffered != 60 {
+		t.Fatalf("stats %+v, expected 2 dropped and 60 buffered", stats)
+	}
+
+	buff := make([]byte, 100)
+	if n, err := remote.Read(buff); err != nil || !bytes.Equal(buff[:n], datagram(0, 60)) {
+		t.Fatalf("read %d bytes, %v, expected first datagram", n, err)
+	}
+	local.Write(datagram(3, 60)) // Fit after read
+	if n, err := remote.Read(buff); err != nil || !bytes.Equal(buff[:n], datagram(3, 60)) {
+		t.Fatalf("read %d bytes, %v, expected datagram after drop", n, err)
+	} else if stats := local.Stats(); stats.Dropped != 2 {
+		t.Fatalf("%d dropped, expected 2", stats.Dropped)
+	}
+}
+
+// Result of Write running in background
+func writeAsync(conn net.Conn, data []byte) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		n, err := conn.Write(data)
+		if err == nil && n != len(data) {
+			err = io.ErrShortWrite
+		}
+		done <- err
+	}()
+	return done
+}
+
+func blocked(t *testing.T, done <-chan error) {
+	select {
+	case err := <-done:
+		t.Fatalf("write return %v with buffer full", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func wakeup(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("write not wake up")
+		return nil
+	}
+}
+
+// Stream Write wait Read when buffer is full, Drop config drop complete write
+func TestCapacity(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		local, remote := CreateBufferedPipe(addr, addr, BufferConfig{Capacity: 10})
+		done := writeAsync(local, datagram(1, 25))
+		blocked(t, done)
+		if stats := local.Stats(); stats.Buffered != 10 {
+			t.Fatalf("%d bytes buffered, capacity 10", stats.Buffered)
+		}
+		data, err := io.ReadAll(io.LimitReader(remote, 25))
+		if err != nil || !bytes.Equal(data, datagram(1, 25)) {
+			t.Fatalf("read %d bytes, %v", len(data), err)
+		} else if err = wakeup(t, done); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("drop", func(t *testing.T) {
+		local, _ := CreateBufferedPipe(addr, addr, BufferConfig{Capacity: 10, Drop: true})
+		for index := 0; index < 2; index++ {
+			if err := wakeup(t, writeAsync(local, datagram(index, 8))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stats := local.Stats(); stats.Buffered != 8 || stats.Dropped != 1 {
+			t.Fatalf("stats %+v, expected 8 buffered and 1 dropped", stats)
+		}
+	})
+}
+
+func timeout(err error) bool {
+	var opErr net.Error
+	return errors.As(err, &opErr) && opErr.Timeout() && errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// Deadline set while Read or Write wait wake up operation
+func TestDeadline(t *testing.T) {
+	t.Run("read", func(t *testing.T) {
+		local, _ := CreateBufferedPipe(addr, addr, BufferConfig{})
+		done := make(chan error, 1)
+		go func() {
+			_, err := local.Read(make([]byte, 10))
+			done <- err
+		}()
+		blocked(t, done)
+		local.SetReadDeadline(time.Now().Add(-time.Second))
+		if err := wakeup(t, done); !timeout(err) {
+			t.Fatalf("read after deadline return %v", err)
+		}
+		local.SetReadDeadline(time.Time{}) // Deadline can be refreshed after timeout
+		local.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		if _, err := local.Read(make([]byte, 10)); !timeout(err) {
+			t.Fatalf("read with future deadline return %v", err)
+		}
+	})
+	t.Run("write", func(t *testing.T) {
+		local, _ := CreateBufferedPipe(addr, addr, BufferConfig{Capacity: 10})
+		done := writeAsync(local, datagram(1, 20))
+		blocked(t, done)
+		local.SetWriteDeadline(time.Now().Add(-time.Second))
+		if err := wakeup(t, done); !timeout(err) {
+			t.Fatalf("write after deadline return %v", err)
+		}
+	})
+}
+
+// Remote read data written before CloseWrite then io.EOF, and still write to local
+func TestCloseWrite(t *testing.T) {
+	local, remote := CreateBufferedPipe(addr, addr, BufferConfig{})
+	local.Write(datagram(1, 100))
+	local.CloseWrite()
+	if _, err := local.Write(datagram(2, 1)); err != io.ErrClosedPipe {
+		t.Fatalf("write after CloseWrite return %v", err)
+	}
+	if data, err := io.ReadAll(remote); err != nil || !bytes.Equal(data, datagram(1, 100)) {
+		t.Fatalf("remote read %d bytes, %v", len(data), err)
+	}
+
+	remote.Write(datagram(3, 10))
+	buff := make([]byte, 10)
+	if n, err := local.Read(buff); err != nil || !bytes.Equal(buff[:n], datagram(3, 10)) {
+		t.Fatalf("read after CloseWrite return %d bytes, %v", n, err)
+	}
+}
+
+// Abort drop buffered data and both ends see connection reset
+func TestAbort(t *testing.T) {
+	local, remote := CreateBufferedPipe(addr, addr, BufferConfig{})
+	local.Write(datagram(1, 100))
+	remote.Write(datagram(2, 100))
+	local.Abort()
+	if _, err := remote.Read(make([]byte, 100)); !IsReset(err) {
+		t.Fatalf("remote read after abort return %v", err)
+	} else if _, err = remote.Write(datagram(3, 10)); !IsReset(err) {
+		t.Fatalf("remote write after abort return %v", err)
+	} else if stats := remote.Stats(); stats.Buffered != 0 {
+		t.Fatalf("%d bytes buffered after abort", stats.Buffered)
+	}
+}
+
+func TestStats(t *testing.T) {
+	local, remote := CreateBufferedPipe(addr, addr, BufferConfig{Capacity: 100, Drop: true})
+	local.Write(datagram(1, 40))
+	local.Write(datagram(2, 50))
+	local.Write(datagram(3, 20)) // Dropped
+	remote.Read(make([]byte, 90))
+	local.Write(datagram(4, 30))
+	if stats := local.Stats(); stats != (Stats{Buffered: 30, HighWater: 90, Capacity: 100, Dropped: 1}) {
+		t.Fatalf("stats %+v", stats)
+	} else if stats = remote.Stats(); stats != (Stats{Capacity: 100}) {
+		t.Fatalf("remote stats %+v, nothing written", stats)
+	}
+}
@@ -5,13 +5,39 @@
 package pipe
 
 import (
-	"io"
+	"errors"
 	"net"
-	"os"
 	"sync"
+	"syscall"
 	"time"
 )
 
+// Peer aborted connection, same error of TCP connection reset
+var ErrReset error = syscall.ECONNRESET
+
+// Connection reset by peer
+func IsReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// Shutdown write side of conn, close conn if not support half close
+func CloseWrite(conn net.Conn) error {
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// Close conn and peer see connection reset, TCP connections send RST
+func Abort(conn net.Conn) error {
+	if aborter, ok := conn.(interface{ Abort() error }); ok {
+		return aborter.Abort()
+	} else if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	return conn.Close()
+}
+
 // pipeDeadline is an abstraction for handling timeouts.
 type pipeDeadline struct {
 	mu     sync.Mutex // Guards timer and cancel
@@ -79,164 +105,3 @@ func isClosedChan(c <-chan struct{}) bool {
 		return false
 	}
 }
-
-type pipe struct {
-	localAddr, remoteAddr net.Addr
-
-	wrMu sync.Mutex // Serialize Write operations
-
-	// Used by local Read to interact with remote Write.
-	// Successful receive on rdRx is always followed by send on rdTx.
-	rdRx <-chan []byte
-	rdTx chan<- int
-
-	// Used by local Write to interact with remote Read.
-	// Successful send on wrTx is always followed by receive on wrRx.
-	wrTx chan<- []byte
-	wrRx <-chan int
-
-	once       sync.Once // Protects closing localDone
-	localDone  chan struct{}
-	remoteDone <-chan struct{}
-
-	readDeadline  pipeDeadline
-	writeDeadline pipeDeadline
-}
-
-// Pipe creates a synchronous, in-memory, full duplex
-// network connection; both ends implement the [Conn] interface.
-// Reads on one end are matched with writes on the other,
-// copying data directly between the two; there is no internal
-// buffering.
-func CreatePipe(LocalAddress, RemoteAddress net.Addr) (net.Conn, net.Conn) {
-	cb1 := make(chan []byte)
-	cb2 := make(chan []byte)
-	cn1 := make(chan int)
-	cn2 := make(chan int)
-	done1 := make(chan struct{})
-	done2 := make(chan struct{})
-
-	p1 := &pipe{
-		localAddr:  LocalAddress,
-		remoteAddr: RemoteAddress,
-
-		rdRx: cb1, rdTx: cn1,
-		wrTx: cb2, wrRx: cn2,
-		localDone: done1, remoteDone: done2,
-		readDeadline:  makePipeDeadline(),
-		writeDeadline: makePipeDeadline(),
-	}
-	p2 := &pipe{
-		localAddr:  LocalAddress,
-		remoteAddr: RemoteAddress,
-
-		rdRx: cb2, rdTx: cn2,
-		wrTx: cb1, wrRx: cn1,
-		localDone: done2, remoteDone: done1,
-		readDeadline:  makePipeDeadline(),
-		writeDeadline: makePipeDeadline(),
-	}
-	return p1, p2
-}
-
-func (p *pipe) LocalAddr() net.Addr  { return p.localAddr }
-func (p *pipe) RemoteAddr() net.Addr { return p.remoteAddr }
-
-func (p *pipe) Read(b []byte) (int, error) {
-	n, err := p.read(b)
-	if err != nil && err != io.EOF && err != io.ErrClosedPipe {
-		err = &net.OpError{Op: "read", Net: "udp", Err: err}
-	}
-	return n, err
-}
-
-func (p *pipe) read(b []byte) (n int, err error) {
-	switch {
-	case isClosedChan(p.localDone):
-		return 0, io.ErrClosedPipe
-	case isClosedChan(p.remoteDone):
-		return 0, io.EOF
-	case isClosedChan(p.readDeadline.wait()):
-		return 0, os.ErrDeadlineExceeded
-	}
-
-	select {
-	case bw := <-p.rdRx:
-		nr := copy(b, bw)
-		p.rdTx <- nr
-		return nr, nil
-	case <-p.localDone:
-		return 0, io.ErrClosedPipe
-	case <-p.remoteDone:
-		return 0, io.EOF
-	case <-p.readDeadline.wait():
-		return 0, os.ErrDeadlineExceeded
-	}
-}
-
-func (p *pipe) Write(b []byte) (int, error) {
-	n, err := p.write(b)
-	if err != nil && err != io.ErrClosedPipe {
-		err = &net.OpError{Op: "write", Net: "udp", Err: err}
-	}
-	return n, err
-}
-
-func (p *pipe) write(b []byte) (n int, err error) {
-	switch {
-	case isClosedChan(p.localDone):
-		return 0, io.ErrClosedPipe
-	case isClosedChan(p.remoteDone):
-		return 0, io.ErrClosedPipe
-	case isClosedChan(p.writeDeadline.wait()):
-		return 0, os.ErrDeadlineExceeded
-	}
-
-	p.wrMu.Lock() // Ensure entirety of b is written together
-	defer p.wrMu.Unlock()
-	for once := true; once || len(b) > 0; once = false {
-		select {
-		case p.wrTx <- b:
-			nw := <-p.wrRx
-			b = b[nw:]
-			n += nw
-		case <-p.localDone:
-			return n, io.ErrClosedPipe
-		case <-p.remoteDone:
-			return n, io.ErrClosedPipe
-		case <-p.writeDeadline.wait():
-			return n, os.ErrDeadlineExceeded
-		}
-	}
-	return n, nil
-}
-
-func (p *pipe) SetDeadline(t time.Time) error {
-	if isClosedChan(p.localDone) || isClosedChan(p.remoteDone) {
-		return io.ErrClosedPipe
-	}
-	p.readDeadline.set(t)
-	p.writeDeadline.set(t)
-	return nil
-}
-
-func (p *pipe) SetReadDeadline(t time.Time) error {
-	if isClosedChan(p.localDone) || isClosedChan(p.remoteDone) {
-		return io.ErrClosedPipe
-	}
-	p.readDeadline.set(t)
-	return nil
-}
-
-func (p *pipe) SetWriteDeadline(t time.Time) error {
-	if isClosedChan(p.localDone) || isClosedChan(p.remoteDone) {
-		return io.ErrClosedPipe
-	}
-	p.writeDeadline.set(t)
-	return nil
-}
-
-func (p *pipe) Close() error {
-	p.once.Do(func() { close(p.localDone) })
-	return nil
-}
@@ -0,0 +1,35 @@
+package pmtu
+
+import (
+	"net"
+	"syscall"
+)
+
+// Set don't fragment in UDP socket, datagrams bigger than path MTU are dropped instead of IP fragmented
+func SetDontFragment(conn net.Conn) error {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sysConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	isIPv4 := false
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		isIPv4 = addr.IP.To4() != nil
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO) // IPv4 mapped in dual stack socket
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package pmtu
+
+import "net"
+
+// Don't fragment is not set in this system, probes bigger than path MTU can be IP fragmented
+func SetDontFragment(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,84 @@
+// Path MTU discovery to datagram transports (RFC 8899 like), agent send probes padded to size
+// with don't fragment set and largest size echoed by controller is used to ClientData frames.
+package pmtu
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
+)
+
+var (
+	Probes       []uint16      = []uint16{1232, 1452, 1472, 8972, proto.MaxDatagramSize} // Sizes probed in order: IPv6 min MTU, ethernet IPv6/IPv4, jumbo frames
+	Attempts     int           = 3                                                       // Probes sent to each size before stop
+	ProbeTimeout time.Duration = time.Second                                             // Time to wait echo
+)
+
+// Connection send datagrams and need path MTU discovery
+func IsDatagram(conn net.Conn) bool {
+	addr := conn.LocalAddr()
+	return addr != nil && strings.HasPrefix(addr.Network(), "udp")
+}
+
+// Datagram size before discovery, stream transports not have MTU
+func Initial(conn net.Conn) uint16 {
+	if IsDatagram(conn) {
+		return proto.MinDatagramSize
+	}
+	return proto.MaxDatagramSize
+}
+
+// Send probes and wait echos from other side
+type Prober struct {
+	echo chan uint16
+}
+
+func NewProber() *Prober {
+	return &Prober{echo: make(chan uint16, 1)}
+}
+
+// Echo recived from other side
+func (prober *Prober) Echo(size uint16) {
+	select {
+	case prober.echo <- size:
+	default: // Discover not waiting
+	}
+}
+
+// Probe sizes in ascending order and return largest size echoed, stop on first size without echo.
+// Send error is probe lost, datagram bigger than local interface MTU fail on write.
+func (prober *Prober) Discover(send func(size uint16) error) uint16 {
+	size := proto.MinDatagramSize
+	for _, probe := range Probes {
+		if probe <= size || probe > proto.MaxDatagramSize {
+			continue
+		} else if !prober.probe(probe, send) {
+			break
+		}
+		size = probe
+	}
+	return size
+}
+
+func (prober *Prober) probe(size uint16, send func(size uint16) error) bool {
+	for attempt := 0; attempt < Attempts; attempt++ {
+		if err := send(size); err != nil {
+			return false
+		}
+		timeout := time.After(ProbeTimeout)
+		for {
+			select {
+			case echo := <-prober.echo:
+				if echo != size {
+					continue // Late echo from smaller probe
+				}
+				return true
+			case <-timeout:
+			}
+			break
+		}
+	}
+	return false
+}
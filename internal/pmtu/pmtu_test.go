@@ -0,0 +1,85 @@
+package pmtu
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
+)
+
+// Path echo probes up to mtu, bigger probes are lost
+func path(prober *Prober, mtu uint16) func(size uint16) error {
+	return func(size uint16) error {
+		if size <= mtu {
+			go prober.Echo(size)
+		}
+		return nil
+	}
+}
+
+func fastProbes(t *testing.T) {
+	oldAttempts, oldTimeout := Attempts, ProbeTimeout
+	Attempts, ProbeTimeout = 2, 20*time.Millisecond
+	t.Cleanup(func() { Attempts, ProbeTimeout = oldAttempts, oldTimeout })
+}
+
+func TestDiscover(t *testing.T) {
+	fastProbes(t)
+	for _, mtu := range []uint16{proto.MinDatagramSize, 1232, 1472, 8972, proto.MaxDatagramSize} {
+		prober := NewProber()
+		if size := prober.Discover(path(prober, mtu)); size != mtu {
+			t.Errorf("path with mtu %d discover %d", mtu, size)
+		}
+	}
+}
+
+// Write error is lost probe, datagram bigger than interface MTU
+func TestDiscoverSendError(t *testing.T) {
+	fastProbes(t)
+	var sent []uint16
+	size := NewProber().Discover(func(size uint16) error {
+		sent = append(sent, size)
+		return errors.New("message too long")
+	})
+	if size != proto.MinDatagramSize {
+		t.Fatalf("discover %d with send error", size)
+	} else if len(sent) != 1 {
+		t.Fatalf("sent %v, stop after first send error", sent)
+	}
+}
+
+// Late echo of smaller probe not confirm current probe
+func TestDiscoverLateEcho(t *testing.T) {
+	fastProbes(t)
+	prober := NewProber()
+	size := prober.Discover(func(size uint16) error {
+		if size == 1232 {
+			prober.Echo(size)
+		} else {
+			go prober.Echo(1232) // Duplicated echo of first probe
+		}
+		return nil
+	})
+	if size != 1232 {
+		t.Fatalf("discover %d from late echo", size)
+	}
+}
+
+func TestInitial(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	stream, other := net.Pipe()
+	defer stream.Close()
+	defer other.Close()
+
+	if size := Initial(udp); size != proto.MinDatagramSize {
+		t.Errorf("UDP initial size %d", size)
+	} else if size = Initial(stream); size != proto.MaxDatagramSize {
+		t.Errorf("stream initial size %d", size)
+	}
+}
@@ -0,0 +1,251 @@
+// Ordered write queue to client connections, one goroutine write to connection in order
+// and writers block when queue is full to apply backpressure to controller connection.
+package queue
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pipe"
+)
+
+var FlushTimeout time.Duration = time.Second * 5 // Time to write queued data after Close before drop
+
+type Stats struct {
+	Depth    int    // Writes waiting in queue
+	MaxDepth int    // Max depth reached
+	Size     int    // Queue capacity in writes, zero if queue is limited by bytes
+	Bytes    int    // Bytes waiting in queue
+	Limit    int    // Queue capacity in bytes, zero if queue is limited by writes
+	Queued   uint64 // Writes queued
+	Written  uint64 // Bytes written to connection
+	Blocked  uint64 // Writes blocked because queue is full
+}
+
+type Conn struct {
+	net.Conn // Client connection
+
+	mu      sync.Mutex
+	pending [][]byte      // Writes waiting writer goroutine
+	bytes   int           // Bytes in pending
+	size    int           // Max writes in pending, zero if limited by bytes
+	limit   int           // Max bytes in pending, zero if limited by writes
+	ready   chan struct{} // Wake writer goroutine after Write
+	space   chan struct{} // Wake Write waiting space after writer take data
+
+	done      chan struct{} // Closed on Close or CloseWrite, stop accept writes
+	closeOnce sync.Once
+	closed    chan struct{} // Closed on Close, close connection after flush
+	fullOnce  sync.Once
+	err       atomic.Pointer[error] // First write error
+	onWrite   func(n int)           // Called after data written to connection
+
+	maxDepth atomic.Int64
+	queued   atomic.Uint64
+	written  atomic.Uint64
+	blocked  atomic.Uint64
+}
+
+// Create queue with size writes to conn and start writer
+func NewConn(conn net.Conn, size int) *Conn {
+	return NewConnFunc(conn, size, nil)
+}
+
+// Create queue and call onWrite with bytes written to conn, to flow control consume data
+func NewConnFunc(conn net.Conn, size int, onWrite func(n int)) *Conn {
+	return newConn(conn, max(size, 1), 0, onWrite)
+}
+
+// Create queue limited by limit bytes instead of writes, small writes not fill queue before flow control window
+func NewConnBytes(conn net.Conn, limit int, onWrite func(n int)) *Conn {
+	return newConn(conn, 0, max(limit, 1), onWrite)
+}
+
+func newConn(conn net.Conn, size, limit int, onWrite func(n int)) *Conn {
+	queue := &Conn{
+		Conn:    conn,
+		size:    size,
+		limit:   limit,
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+		onWrite: onWrite,
+	}
+	go queue.writer()
+	return queue
+}
+
+func notify(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func (queue *Conn) writer() {
+	defer queue.Conn.Close()
+	if !queue.drain() {
+		return // Write error, connection broken
+	}
+	select {
+	case <-queue.closed:
+	default:
+		pipe.CloseWrite(queue.Conn) // Only write closed, connection still read until Close
+		<-queue.closed
+	}
+}
+
+// Write queue until done, false on write error
+func (queue *Conn) drain() bool {
+	for {
+		if data, ok := queue.next(); ok {
+			if !queue.write(data) {
+				return false
+			}
+			continue
+		}
+		select {
+		case <-queue.ready:
+		case <-queue.done:
+			// Flush data queued before close
+			for {
+				data, ok := queue.next()
+				if !ok {
+					return true
+				} else if !queue.write(data) {
+					return false
+				}
+			}
+		}
+	}
+}
+
+// Take next write from queue and wake Write waiting space
+func (queue *Conn) next() ([]byte, bool) {
+	queue.mu.Lock()
+	if len(queue.pending) == 0 {
+		queue.mu.Unlock()
+		return nil, false
+	}
+	data := queue.pending[0]
+	queue.pending[0] = nil
+	queue.pending = queue.pending[1:]
+	queue.bytes -= len(data)
+	queue.mu.Unlock()
+	notify(queue.space)
+	return data, true
+}
+
+func (queue *Conn) write(data []byte) bool {
+	n, err := queue.Conn.Write(data)
+	queue.written.Add(uint64(n))
+	if queue.onWrite != nil && n > 0 {
+		queue.onWrite(n)
+	}
+	if err != nil {
+		queue.err.CompareAndSwap(nil, &err)
+		queue.closeOnce.Do(func() { close(queue.done) })
+		queue.fullOnce.Do(func() { close(queue.closed) })
+		return false
+	}
+	return true
+}
+
+// Write fit in queue, empty queue always accept one write. Caller must hold lock
+func (queue *Conn) fits(n int) bool {
+	if len(queue.pending) == 0 {
+		return true
+	} else if queue.limit > 0 {
+		return queue.bytes+n <= queue.limit
+	}
+	return len(queue.pending) < queue.size
+}
+
+// Copy data to queue, block if queue is full
+func (queue *Conn) Write(p []byte) (int, error) {
+	if err := queue.err.Load(); err != nil {
+		return 0, *err
+	}
+	data := append([]byte(nil), p...)
+	for blocked := false; ; blocked = true {
+		select {
+		case <-queue.done:
+			return 0, net.ErrClosed
+		default:
+		}
+		queue.mu.Lock()
+		if queue.fits(len(data)) {
+			queue.pending = append(queue.pending, data)
+			queue.bytes += len(data)
+			depth := int64(len(queue.pending))
+			queue.mu.Unlock()
+			notify(queue.ready)
+			queue.queued.Add(1)
+			if depth > queue.maxDepth.Load() {
+				queue.maxDepth.Store(depth)
+			}
+			return len(p), nil
+		}
+		queue.mu.Unlock()
+		if !blocked {
+			queue.blocked.Add(1)
+		}
+		select {
+		case <-queue.space:
+		case <-queue.done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+// Stop accept writes, data queued is written before close connection
+func (queue *Conn) Close() error {
+	queue.CloseWrite()
+	queue.fullOnce.Do(func() { close(queue.closed) })
+	return nil
+}
+
+// Stop accept writes, data queued is written before shutdown write side of connection
+func (queue *Conn) CloseWrite() error {
+	queue.closeOnce.Do(func() {
+		close(queue.done)
+		queue.Conn.SetWriteDeadline(time.Now().Add(FlushTimeout)) // Not wait client forever
+	})
+	return nil
+}
+
+// Drop data queued and close connection with reset
+func (queue *Conn) Abort() error {
+	queue.mu.Lock()
+	queue.pending, queue.bytes = nil, 0
+	queue.mu.Unlock()
+	queue.closeOnce.Do(func() { close(queue.done) })
+	queue.fullOnce.Do(func() { close(queue.closed) })
+	return pipe.Abort(queue.Conn)
+}
+
+// Writes waiting in queue
+func (queue *Conn) Len() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.pending)
+}
+
+func (queue *Conn) Stats() Stats {
+	queue.mu.Lock()
+	depth, bytes := len(queue.pending), queue.bytes
+	queue.mu.Unlock()
+	return Stats{
+		Depth:    depth,
+		MaxDepth: int(queue.maxDepth.Load()),
+		Size:     queue.size,
+		Bytes:    bytes,
+		Limit:    queue.limit,
+		Queued:   queue.queued.Load(),
+		Written:  queue.written.Load(),
+		Blocked:  queue.blocked.Load(),
+	}
+}
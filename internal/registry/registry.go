@@ -0,0 +1,102 @@
+// Concurrency-safe registry to agents, clients and streams shared by accept, copy and request goroutines
+package registry
+
+import "sync"
+
+type Registry[K comparable, V comparable] struct {
+	mu      sync.RWMutex
+	entries map[K]V
+}
+
+// Create empty registry
+func New[K comparable, V comparable]() *Registry[K, V] {
+	return &Registry[K, V]{entries: make(map[K]V)}
+}
+
+// Get value from key
+func (reg *Registry[K, V]) Load(key K) (value V, ok bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	value, ok = reg.entries[key]
+	return
+}
+
+// Set value to key, replace if exists
+func (reg *Registry[K, V]) Store(key K, value V) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.entries[key] = value
+}
+
+// Return current value if exists, else set value, loaded is true if value already exists
+func (reg *Registry[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if actual, loaded = reg.entries[key]; loaded {
+		return
+	}
+	reg.entries[key] = value
+	return value, false
+}
+
+// Remove key
+func (reg *Registry[K, V]) Delete(key K) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.entries, key)
+}
+
+// Remove key and return old value
+func (reg *Registry[K, V]) LoadAndDelete(key K) (value V, ok bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if value, ok = reg.entries[key]; ok {
+		delete(reg.entries, key)
+	}
+	return
+}
+
+// Remove key only if value is old, value replaced by other goroutine is keeped
+func (reg *Registry[K, V]) CompareAndDelete(key K, old V) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if value, ok := reg.entries[key]; ok && value == old {
+		delete(reg.entries, key)
+		return true
+	}
+	return false
+}
+
+// Entries count
+func (reg *Registry[K, V]) Len() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return len(reg.entries)
+}
+
+// Call fn with snapshot of entries, fn can modify registry, stop if fn return false
+func (reg *Registry[K, V]) Range(fn func(key K, value V) bool) {
+	reg.mu.RLock()
+	keys, values := make([]K, 0, len(reg.entries)), make([]V, 0, len(reg.entries))
+	for key, value := range reg.entries {
+		keys, values = append(keys, key), append(values, value)
+	}
+	reg.mu.RUnlock()
+	for index := range keys {
+		if !fn(keys[index], values[index]) {
+			return
+		}
+	}
+}
+
+// Remove all entries and return removed values
+func (reg *Registry[K, V]) Drain() []V {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	values := make([]V, 0, len(reg.entries))
+	for key, value := range reg.entries {
+		values = append(values, value)
+		delete(reg.entries, key)
+	}
+	return values
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type testClient struct {
+	closes atomic.Int32
+}
+
+// Open and close clients like accept, copy and request goroutines, each client must be closed once
+func TestConcurrentOpenClose(t *testing.T) {
+	const clients = 500
+	reg := New[string, *testClient]()
+	opened := make([]*testClient, clients)
+
+	var wg sync.WaitGroup
+	for index := range opened {
+		client := &testClient{}
+		opened[index] = client
+		key := fmt.Sprintf("127.0.0.1:%d", 1024+index)
+		wg.Add(1)
+		go func() { // Accept
+			defer wg.Done()
+			reg.Store(key, client)
+			wg.Add(3)
+			go func() { // Copy end
+				defer wg.Done()
+				if reg.CompareAndDelete(key, client) {
+					client.closes.Add(1)
+				}
+			}()
+			go func() { // Peer close
+				defer wg.Done()
+				if client, ok := reg.LoadAndDelete(key); ok {
+					client.closes.Add(1)
+				}
+			}()
+			go func() { // Stats
+				defer wg.Done()
+				reg.Load(key)
+				reg.Len()
+				reg.Range(func(key string, client *testClient) bool { return true })
+			}()
+		}()
+	}
+
+	wg.Add(1)
+	go func() { // Tunnel closed while clients connect
+		defer wg.Done()
+		for _, client := range reg.Drain() {
+			client.closes.Add(1)
+		}
+	}()
+	wg.Wait()
+
+	for _, client := range reg.Drain() {
+		client.closes.Add(1)
+	}
+	for index, client := range opened {
+		if closes := client.closes.Load(); closes != 1 {
+			t.Errorf("client %d closed %d times", index, closes)
+		}
+	}
+	if reg.Len() != 0 {
+		t.Errorf("registry has %d clients after close", reg.Len())
+	}
+}
+
+func TestLoadOrStore(t *testing.T) {
+	reg := New[string, int]()
+	var stored atomic.Int32
+	var wg sync.WaitGroup
+	for index := 0; index < 200; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, loaded := reg.LoadOrStore("half-closed", index); !loaded {
+				stored.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if stored.Load() != 1 {
+		t.Fatalf("%d goroutines stored same key", stored.Load())
+	}
+}
@@ -0,0 +1,352 @@
+// Sequence, acknowledge and retransmit packets from byte streams sent over unreliable transport (UDP)
+package reliable
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/congestion"
+)
+
+const (
+	Window     int           = 256                    // Max segments in flight and buffered out of order
+	InitialRTO time.Duration = time.Second            // RTO before first RTT sample
+	MinRTO     time.Duration = 200 * time.Millisecond // Lower bound to RTO
+	MaxRTO     time.Duration = 60 * time.Second       // Upper bound to RTO
+	MaxRetries int           = 12                     // Retransmissions of same segment before give up
+	DupAcks    int           = 3                      // Duplicated acks to fast retransmit
+)
+
+var (
+	ErrRetransmitLimit error = errors.New("segment retransmitted too many times without ack")
+)
+
+type segment struct {
+	seq     uint64
+	data    []byte
+	sent    time.Time
+	retries int
+}
+
+// Reliable stream to one client, seq 0 is reserved to unsequenced packets
+type Stream struct {
+	send    func(seq uint64, data []byte) error // Transmit data segment to other side
+	sendAck func(ack uint64) error              // Transmit cumulative ack (next seq expected) to other side
+	deliver func(data []byte) error             // Write in-order data to local connection
+
+	cc                congestion.Controller // Limit segments in flight, called with sendMu
+	sendMu            sync.Mutex
+	sendCond          *sync.Cond
+	nextSeq, lastAck  uint64
+	recover           uint64     // Highest seq sent when loss detected, acks below it are partial
+	unacked           []*segment // Segments sent and not acked, ordered by seq
+	dupAcks           int
+	srtt, rttvar, rto time.Duration
+	timer             *time.Timer
+	err               error // Error to writers, set on close
+
+	recvMu     sync.Mutex
+	expected   uint64            // Next seq to queue to deliver
+	delivered  uint64            // Next seq to deliver, ack sent to other side
+	ready      [][]byte          // Segments in order waiting deliver
+	delivering bool              // One Receive call deliver ready segments outside recvMu
+	outOfOrder map[uint64][]byte // Segments after expected
+	recvErr    error             // Deliver error, stream is closed
+}
+
+// Create new stream, send and sendAck are called to transmit frames, deliver recive data in order
+func NewStream(send func(seq uint64, data []byte) error, sendAck func(ack uint64) error, deliver func(data []byte) error) *Stream {
+	return NewStreamCongestion(congestion.NewNewReno(Window), send, sendAck, deliver)
+}
+
+// Create new stream with congestion controller, controller window is capped by Window
+func NewStreamCongestion(cc congestion.Controller, send func(seq uint64, data []byte) error, sendAck func(ack uint64) error, deliver func(data []byte) error) *Stream {
+	stream := &Stream{
+		cc:         cc,
+		send:       send,
+		sendAck:    sendAck,
+		deliver:    deliver,
+		nextSeq:    1,
+		lastAck:    1,
+		rto:        InitialRTO,
+		expected:   1,
+		delivered:  1,
+		outOfOrder: make(map[uint64][]byte),
+	}
+	stream.sendCond = sync.NewCond(&stream.sendMu)
+	stream.timer = time.AfterFunc(MaxRTO, stream.onTimeout)
+	stream.timer.Stop()
+	return stream
+}
+
+// Current retransmission timeout
+func (stream *Stream) RTO() time.Duration {
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	return stream.rto
+}
+
+// Congestion controller state
+func (stream *Stream) Congestion() congestion.Stats {
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	return stream.cc.Stats()
+}
+
+// Segments allowed in flight
+func (stream *Stream) window() int {
+	return max(min(stream.cc.Window(), Window), 1)
+}
+
+// Sequence and send data, block if send window is full
+func (stream *Stream) Write(w []byte) (int, error) {
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	for stream.err == nil && len(stream.unacked) >= stream.window() {
+		stream.sendCond.Wait()
+	}
+	if stream.err != nil {
+		return 0, stream.err
+	}
+
+	seg := &segment{seq: stream.nextSeq, data: append([]byte(nil), w...), sent: time.Now()}
+	stream.nextSeq++
+	if stream.unacked = append(stream.unacked, seg); len(stream.unacked) == 1 {
+		stream.timer.Reset(stream.rto)
+	}
+	if err := stream.transmit(seg); err != nil {
+		return 0, err
+	}
+	return len(w), nil
+}
+
+// Clear backoff and retransmit all segments without ack, used after transport reconnect
+func (stream *Stream) Resume() {
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	if stream.err != nil || len(stream.unacked) == 0 {
+		return
+	}
+	stream.rto = stream.computeRTO()
+	for _, seg := range stream.unacked {
+		if stream.retransmit(seg) != nil {
+			return
+		}
+	}
+	stream.timer.Reset(stream.rto)
+}
+
+// Wait all data sent be acknowledged
+func (stream *Stream) Flush(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		stream.sendMu.Lock()
+		defer stream.sendMu.Unlock()
+		stream.sendCond.Broadcast()
+	})
+	defer stop()
+
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	for stream.err == nil && len(stream.unacked) > 0 && ctx.Err() == nil {
+		stream.sendCond.Wait()
+	}
+	if stream.err != nil && stream.err != io.ErrClosedPipe {
+		return stream.err
+	}
+	return ctx.Err()
+}
+
+// Process cumulative ack recived from other side
+func (stream *Stream) Ack(ack uint64) {
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	if stream.err != nil || ack > stream.nextSeq {
+		return
+	} else if ack <= stream.lastAck {
+		if ack == stream.lastAck && len(stream.unacked) > 0 {
+			if stream.dupAcks++; stream.dupAcks == DupAcks && stream.lastAck >= stream.recover {
+				stream.recover = stream.nextSeq
+				stream.cc.OnLoss()
+				stream.retransmit(stream.unacked[0]) // Fast retransmit
+			}
+		}
+		return
+	}
+
+	// Karn's algorithm, only sample if none of acked segments is retransmitted
+	acked, sample := 0, true
+	for ; acked < len(stream.unacked) && stream.unacked[acked].seq < ack; acked++ {
+		sample = sample && stream.unacked[acked].retries == 0
+	}
+	var rtt time.Duration
+	if sample {
+		rtt = time.Since(stream.unacked[acked-1].sent)
+		stream.sampleRTT(rtt)
+	}
+	stream.cc.OnAck(acked, rtt)
+	stream.unacked = stream.unacked[acked:]
+	stream.lastAck, stream.dupAcks = ack, 0
+	stream.rto = stream.computeRTO() // Clear backoff
+
+	// Partial ack on recovery, next segment is lost too
+	if len(stream.unacked) > 0 && ack < stream.recover {
+		stream.retransmit(stream.unacked[0])
+	}
+
+	stream.timer.Stop()
+	if len(stream.unacked) > 0 {
+		stream.timer.Reset(max(time.Until(stream.unacked[0].sent.Add(stream.rto)), 0))
+	}
+	stream.sendCond.Broadcast()
+}
+
+// RFC 6298 RTT estimation
+func (stream *Stream) sampleRTT(rtt time.Duration) {
+	if stream.srtt == 0 {
+		stream.srtt, stream.rttvar = rtt, rtt/2
+	} else {
+		diff := stream.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		stream.rttvar = (3*stream.rttvar + diff) / 4
+		stream.srtt = (7*stream.srtt + rtt) / 8
+	}
+}
+
+func (stream *Stream) computeRTO() time.Duration {
+	if stream.srtt == 0 {
+		return InitialRTO
+	}
+	return min(max(stream.srtt+4*stream.rttvar, MinRTO), MaxRTO)
+}
+
+// Transport lost, segment is retransmitted after RTO or Resume on new connection
+func transient(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// Send segment, other errors than transport close stream, caller must hold sendMu
+func (stream *Stream) transmit(seg *segment) error {
+	if err := stream.send(seg.seq, seg.data); err != nil && !transient(err) {
+		stream.closeSend(err)
+		return err
+	}
+	return nil
+}
+
+func (stream *Stream) retransmit(seg *segment) error {
+	seg.retries++
+	seg.sent = time.Now()
+	return stream.transmit(seg)
+}
+
+// Retransmit first segment without ack after RTO
+func (stream *Stream) onTimeout() {
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	if stream.err != nil || len(stream.unacked) == 0 {
+		return
+	}
+
+	seg := stream.unacked[0]
+	if wait := time.Until(seg.sent.Add(stream.rto)); wait > 0 {
+		stream.timer.Reset(wait) // Timer from old segment
+		return
+	} else if seg.retries >= MaxRetries {
+		stream.closeSend(ErrRetransmitLimit)
+		return
+	}
+	stream.recover = stream.nextSeq
+	stream.cc.OnTimeout()
+	if stream.retransmit(seg) != nil {
+		return
+	}
+	stream.rto = min(stream.rto*2, MaxRTO) // Backoff
+	stream.timer.Reset(stream.rto)
+}
+
+// Process segment recived from other side, data is delivered in order and ack sent back.
+// Deliver error close stream and is returned to this and next calls
+func (stream *Stream) Receive(seq uint64, data []byte) error {
+	stream.recvMu.Lock()
+	if stream.recvErr != nil {
+		stream.recvMu.Unlock()
+		return stream.recvErr
+	}
+	if seq == stream.expected {
+		stream.ready = append(stream.ready, data)
+		for stream.expected++; ; stream.expected++ {
+			next, ok := stream.outOfOrder[stream.expected]
+			if !ok {
+				break
+			}
+			delete(stream.outOfOrder, stream.expected)
+			stream.ready = append(stream.ready, next)
+		}
+	} else if seq > stream.expected && seq < stream.delivered+uint64(Window) {
+		if _, exist := stream.outOfOrder[seq]; !exist {
+			stream.outOfOrder[seq] = data
+		}
+	}
+	if stream.delivering {
+		stream.recvMu.Unlock()
+		return nil // Other call deliver segments and send ack
+	}
+
+	stream.delivering = true
+	for len(stream.ready) > 0 {
+		ready := stream.ready
+		stream.ready = nil
+		stream.recvMu.Unlock()
+		for _, data := range ready {
+			if err := stream.deliver(data); err != nil {
+				return stream.closeReceive(err)
+			}
+		}
+		stream.recvMu.Lock()
+		stream.delivered += uint64(len(ready))
+	}
+	stream.delivering = false
+	ack := stream.delivered
+	stream.recvMu.Unlock()
+	return stream.sendAck(ack)
+}
+
+// Local connection failed, drop segments not delivered and close stream with error
+func (stream *Stream) closeReceive(err error) error {
+	stream.recvMu.Lock()
+	stream.recvErr, stream.delivering = err, false
+	stream.ready, stream.outOfOrder = nil, nil
+	stream.recvMu.Unlock()
+
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	if stream.err == nil {
+		stream.closeSend(err)
+	}
+	return err
+}
+
+func (stream *Stream) closeSend(err error) {
+	stream.err = err
+	stream.timer.Stop()
+	stream.unacked = nil
+	stream.sendCond.Broadcast()
+}
+
+// Stop retransmissions and release writers
+func (stream *Stream) Close() error {
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	if stream.err != nil {
+		return nil
+	}
+	stream.closeSend(io.ErrClosedPipe)
+	return nil
+}
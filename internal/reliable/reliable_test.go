@@ -0,0 +1,265 @@
+package reliable
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Link between streams, segments are dropped, duplicated and reordered by random delay
+type link struct {
+	loss, duplicate float64
+	jitter          time.Duration // Max delay, segments sent in this time can be reordered
+
+	mu     sync.Mutex
+	random *rand.Rand
+	sent   int
+}
+
+func newLink(loss, duplicate float64, seed int64) *link {
+	return &link{loss: loss, duplicate: duplicate, jitter: 5 * time.Millisecond, random: rand.New(rand.NewSource(seed))}
+}
+
+func (link *link) send(deliver func()) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	link.sent++
+	if link.random.Float64() < link.loss {
+		return
+	}
+	copies := 1
+	if link.random.Float64() < link.duplicate {
+		copies++
+	}
+	for ; copies > 0; copies-- {
+		time.AfterFunc(time.Duration(link.random.Int63n(int64(link.jitter))), deliver)
+	}
+}
+
+func nop(uint64, []byte) error { return nil }
+
+// Data arrive in order and complete over link that lose, duplicate and reorder segments and acks
+func TestLossyLink(t *testing.T) {
+	if testing.Short() {
+		t.Skip("link simulator run in real time")
+	}
+	const segments = 500
+	forward, back := newLink(0.1, 0.1, 1), newLink(0.05, 0.05, 2)
+
+	var mu sync.Mutex
+	var next uint64
+	var sender, receiver *Stream
+	sender = NewStream(func(seq uint64, data []byte) error {
+		forward.send(func() { receiver.Receive(seq, data) })
+		return nil
+	}, func(uint64) error { return nil }, func([]byte) error { return nil })
+	receiver = NewStream(nop, func(ack uint64) error {
+		back.send(func() { sender.Ack(ack) })
+		return nil
+	}, func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if index := binary.BigEndian.Uint64(data); index != next {
+			t.Errorf("segment %d delivered, expected %d", index, next)
+		}
+		next++
+		return nil
+	})
+	defer sender.Close()
+	defer receiver.Close()
+
+	for index := uint64(0); index < segments; index++ {
+		if _, err := sender.Write(binary.BigEndian.AppendUint64(nil, index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := sender.Flush(ctx); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	forward.mu.Lock()
+	defer forward.mu.Unlock()
+	if next != segments {
+		t.Fatalf("%d of %d segments delivered", next, segments)
+	} else if forward.sent <= segments {
+		t.Fatalf("%d segments sent, lost segments not retransmitted", forward.sent)
+	} else if stats := sender.Congestion(); stats.Losses+stats.Timeouts == 0 {
+		t.Fatalf("loss not detected, %+v", stats)
+	}
+}
+
+func (stream *Stream) smoothedRTT() time.Duration {
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	return stream.srtt
+}
+
+// Ack of retransmitted segment is ambiguous and not sampled
+func TestKarnRTT(t *testing.T) {
+	stream := NewStream(nop, func(uint64) error { return nil }, func([]byte) error { return nil })
+	defer stream.Close()
+
+	stream.Write([]byte("first"))
+	time.Sleep(20 * time.Millisecond)
+	stream.Ack(2)
+	srtt := stream.smoothedRTT()
+	if srtt < 20*time.Millisecond {
+		t.Fatalf("srtt %s after first sample, expected 20ms", srtt)
+	}
+
+	stream.Write([]byte("retransmitted"))
+	stream.sendMu.Lock()
+	stream.retransmit(stream.unacked[0])
+	stream.sendMu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	stream.Ack(3)
+	if sample := stream.smoothedRTT(); sample != srtt {
+		t.Fatalf("srtt changed from %s to %s by retransmitted segment", srtt, sample)
+	}
+
+	stream.Write([]byte("next"))
+	time.Sleep(100 * time.Millisecond)
+	stream.Ack(4)
+	if sample := stream.smoothedRTT(); sample <= srtt {
+		t.Fatalf("srtt %s not sampled after new segment", sample)
+	}
+}
+
+func TestFastRetransmit(t *testing.T) {
+	sends := make(map[uint64]int)
+	stream := NewStream(func(seq uint64, data []byte) error {
+		sends[seq]++ // Called with sendMu
+		return nil
+	}, func(uint64) error { return nil }, func([]byte) error { return nil })
+	defer stream.Close()
+
+	for index := 0; index < 5; index++ {
+		stream.Write([]byte("segment"))
+	}
+	stream.Ack(2)
+	for index := 0; index < DupAcks; index++ {
+		stream.Ack(2)
+	}
+	stream.sendMu.Lock()
+	defer stream.sendMu.Unlock()
+	if sends[2] != 2 {
+		t.Fatalf("segment 2 sent %d times after %d duplicated acks", sends[2], DupAcks)
+	} else if sends[3] != 1 {
+		t.Fatalf("segment 3 sent %d times, only first without ack is retransmitted", sends[3])
+	}
+}
+
+// Transport errors are retransmitted, other send errors close stream
+func TestSendError(t *testing.T) {
+	errTooBig := errors.New("segment too big")
+	for _, test := range []struct {
+		name string
+		err  error
+		fail bool
+	}{
+		{"transport", &net.OpError{Op: "write", Net: "udp", Err: net.ErrClosed}, false},
+		{"closed", net.ErrClosed, false},
+		{"segment", errTooBig, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stream := NewStream(func(uint64, []byte) error { return test.err }, func(uint64) error { return nil }, func([]byte) error { return nil })
+			defer stream.Close()
+			_, err := stream.Write([]byte("segment"))
+			if test.fail {
+				if err != test.err {
+					t.Fatalf("write return %v", err)
+				} else if _, err = stream.Write([]byte("next")); err != test.err {
+					t.Fatalf("write after send error return %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("write return %v with transport error", err)
+			} else if stream.unacked[0].seq != 1 {
+				t.Fatal("segment not queued to retransmit")
+			}
+		})
+	}
+}
+
+// Deliver error close stream and stop acks
+func TestDeliverError(t *testing.T) {
+	errClosed := errors.New("local connection closed")
+	var delivered, acks int
+	stream := NewStream(nop, func(uint64) error {
+		acks++
+		return nil
+	}, func([]byte) error {
+		if delivered++; delivered > 1 {
+			return errClosed
+		}
+		return nil
+	})
+	defer stream.Close()
+
+	if err := stream.Receive(1, []byte("first")); err != nil {
+		t.Fatal(err)
+	} else if err = stream.Receive(3, []byte("out of order")); err != nil {
+		t.Fatal(err)
+	} else if err = stream.Receive(2, []byte("fail")); err != errClosed {
+		t.Fatalf("receive return %v", err)
+	} else if err = stream.Receive(4, []byte("after close")); err != errClosed {
+		t.Fatalf("receive after error return %v", err)
+	} else if _, err = stream.Write([]byte("reply")); err != errClosed {
+		t.Fatalf("write after deliver error return %v", err)
+	} else if delivered != 2 || acks != 2 {
+		t.Fatalf("%d delivered and %d acks, expected 2 and 2", delivered, acks)
+	}
+}
+
+// Receive not hold lock in deliver, segments recived while deliver wait are delivered in order by first call
+func TestDeliverOutsideLock(t *testing.T) {
+	release, blocked := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	var ack uint64
+	stream := NewStream(nop, func(next uint64) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ack = next
+		return nil
+	}, func(data []byte) error {
+		if string(data) == "slow" {
+			close(blocked)
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, string(data))
+		return nil
+	})
+	defer stream.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- stream.Receive(1, []byte("slow")) }()
+	<-blocked
+	if err := stream.Receive(3, []byte("third")); err != nil {
+		t.Fatal(err)
+	} else if err = stream.Receive(2, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 3 || order[0] != "slow" || order[1] != "second" || order[2] != "third" {
+		t.Fatalf("delivered %v", order)
+	} else if ack != 4 {
+		t.Fatalf("ack %d after all delivered, expected 4", ack)
+	}
+}
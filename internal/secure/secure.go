@@ -0,0 +1,338 @@
+// Encrypt and authenticate controller connection, server static key is pinned by agent.
+//
+// Handshake (Noise NK like) run before any proto.Request:
+//
+//	agent -> controller: version, agent ephemeral key
+//	controller -> agent: controller ephemeral key, AEAD tag of transcript
+//
+// Keys are derived from DH(agent ephemeral, controller static) and DH(agent ephemeral, controller ephemeral),
+// only controller with static private key can create valid tag. After handshake every Write is
+// sealed with AES-256-GCM in one proto.FrameSealed frame with explicit counter to work with UDP.
+package secure
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/buffer"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pmtu"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
+)
+
+const (
+	Version     uint8 = 1  // Handshake version
+	KeySize     int   = 32 // X25519 key size
+	counterSize int   = 8  // Sealed frame counter
+	replayBits  int   = 64 // Replay window size
+)
+
+var (
+	ErrHandshake        error = errors.New("invalid secure handshake")
+	ErrHandshakeTimeout error = errors.New("secure handshake timeout")
+	ErrServerKey        error = errors.New("controller key not match pinned key")
+	ErrDecrypt          error = errors.New("cannot decrypt frame")
+	ErrReplay           error = errors.New("frame counter replayed")
+
+	protocolName = []byte("pproxit-secure-v1")
+)
+
+type Conn struct {
+	net.Conn                    // Raw connection
+	reader    proto.FrameReader // Buffered raw reader
+	isPacket  bool              // Raw connection is datagram, drop invalid frames and continue
+	send      cipher.AEAD       // Key to seal writes
+	recv      cipher.AEAD       // Key to open reads
+	writeMu   sync.Mutex        // Serialize counter and writes
+	sendCount uint64            // Last counter sent
+	readMu    sync.Mutex        // Serialize reads
+	pending   []byte            // Plaintext not read
+	plain     []byte            // Plaintext buffer reused between frames, pending is slice of it
+	recvMax   uint64            // Max counter recived
+	recvMask  uint64            // Bitmap to counters recived before recvMax
+	hello     []byte            // Server: client hello body, to detect retransmission
+	reply     []byte            // Server: reply sent to client hello
+}
+
+func newConn(conn net.Conn) *Conn {
+	if pmtu.IsDatagram(conn) { // UDP socket or controller peer pipe
+		return &Conn{Conn: conn, isPacket: true, reader: proto.NewDatagramReader(conn)}
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReaderSize(conn, proto.FrameHeaderSize+int(proto.MaxFrameSize))}
+}
+
+// Parse X25519 public key
+func ParsePublicKey(key []byte) (*ecdh.PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(key)
+}
+
+// Parse X25519 private key
+func ParsePrivateKey(key []byte) (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(key)
+}
+
+// Generate new X25519 private key
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// HKDF-SHA256 with one block output
+func deriveKey(salt, secret []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(counter uint64) []byte {
+	buff := make([]byte, 12)
+	binary.BigEndian.PutUint64(buff[4:], counter)
+	return buff
+}
+
+// Derive keys from handshake, return transcript hash to confirm tag
+func (conn *Conn) derive(isServer bool, serverStatic, clientEphemeral, serverEphemeral *ecdh.PublicKey, staticShared, ephemeralShared []byte) ([]byte, error) {
+	transcript := sha256.New()
+	transcript.Write(protocolName)
+	transcript.Write(serverStatic.Bytes())
+	transcript.Write(clientEphemeral.Bytes())
+	transcript.Write(serverEphemeral.Bytes())
+	salt := transcript.Sum(nil)
+
+	secret := append(append([]byte{}, staticShared...), ephemeralShared...)
+	clientKey, err := newAEAD(deriveKey(salt, secret, "agent to controller"))
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := newAEAD(deriveKey(salt, secret, "controller to agent"))
+	if err != nil {
+		return nil, err
+	}
+	if conn.send, conn.recv = clientKey, serverKey; isServer {
+		conn.send, conn.recv = serverKey, clientKey
+	}
+	return salt, nil
+}
+
+// Run agent handshake, hello is resent attempts times if controller not respond in timeout.
+// Datagram replies can be spoofed, so invalid replies are dropped and error is returned only if no valid reply arrives
+func Client(raw net.Conn, serverKey *ecdh.PublicKey, timeout time.Duration, attempts int) (*Conn, error) {
+	conn := newConn(raw)
+	defer raw.SetReadDeadline(time.Time{})
+
+	ephemeral, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	hello := append([]byte{Version}, ephemeral.PublicKey().Bytes()...)
+	var rejected error // Last invalid reply in datagram connection
+	for attempt := 0; attempt < max(attempts, 1); attempt++ {
+		if err := proto.WriteFrame(raw, proto.FrameHandshake, hello); err != nil {
+			return nil, err
+		}
+		raw.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			frameType, body, err := proto.ReadFrame(conn.reader)
+			if err != nil {
+				if opt, isOpt := err.(net.Error); isOpt && opt.Timeout() {
+					break
+				} else if conn.isPacket && isFrameError(err) {
+					conn.reader.Reset(raw)
+					continue
+				}
+				return nil, err
+			} else if frameType != proto.FrameHandshake || len(body) != KeySize+16 {
+				continue
+			} else if err = conn.finish(ephemeral, serverKey, body); err != nil {
+				if conn.isPacket {
+					rejected = err
+					continue
+				}
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	if rejected != nil {
+		return nil, rejected
+	}
+	return nil, ErrHandshakeTimeout
+}
+
+// Derive keys from controller reply, reply tag is valid only if controller has pinned static key
+func (conn *Conn) finish(ephemeral *ecdh.PrivateKey, serverKey *ecdh.PublicKey, reply []byte) error {
+	serverEphemeral, err := ParsePublicKey(reply[:KeySize])
+	if err != nil {
+		return ErrHandshake
+	}
+	staticShared, err := ephemeral.ECDH(serverKey)
+	if err != nil {
+		return ErrHandshake
+	}
+	ephemeralShared, err := ephemeral.ECDH(serverEphemeral)
+	if err != nil {
+		return ErrHandshake
+	}
+	transcript, err := conn.derive(false, serverKey, ephemeral.PublicKey(), serverEphemeral, staticShared, ephemeralShared)
+	if err != nil {
+		return err
+	} else if _, err := conn.recv.Open(nil, nonce(0), reply[KeySize:], transcript); err != nil {
+		return ErrServerKey
+	}
+	return nil
+}
+
+// Wait agent handshake and reply with controller static key
+func Server(raw net.Conn, key *ecdh.PrivateKey, timeout time.Duration) (*Conn, error) {
+	conn := newConn(raw)
+	raw.SetReadDeadline(time.Now().Add(timeout))
+	defer raw.SetReadDeadline(time.Time{})
+
+	frameType, body, err := proto.ReadFrame(conn.reader)
+	if err != nil {
+		if opt, isOpt := err.(net.Error); isOpt && opt.Timeout() {
+			return nil, ErrHandshakeTimeout
+		}
+		return nil, err
+	} else if frameType != proto.FrameHandshake || len(body) != 1+KeySize || body[0] != Version {
+		return nil, ErrHandshake
+	}
+
+	clientEphemeral, err := ParsePublicKey(body[1:])
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	ephemeral, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	staticShared, err := key.ECDH(clientEphemeral)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	ephemeralShared, err := ephemeral.ECDH(clientEphemeral)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	transcript, err := conn.derive(true, key.PublicKey(), clientEphemeral, ephemeral.PublicKey(), staticShared, ephemeralShared)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.hello = body
+	conn.reply = conn.send.Seal(ephemeral.PublicKey().Bytes(), nonce(0), nil, transcript)
+	if err := proto.WriteFrame(raw, proto.FrameHandshake, conn.reply); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func isFrameError(err error) bool {
+	return proto.IsFrameSkippable(err) || errors.Is(err, proto.ErrFrameMagic) || errors.Is(err, proto.ErrFrameTruncated) || errors.Is(err, proto.ErrFrameOversized)
+}
+
+// Check counter in replay window and mark as recived
+func (conn *Conn) checkReplay(counter uint64) bool {
+	if counter == 0 {
+		return false // Reserved to handshake
+	} else if counter > conn.recvMax {
+		if shift := counter - conn.recvMax; shift < uint64(replayBits) {
+			conn.recvMask = conn.recvMask<<shift | 1<<(shift-1)
+		} else {
+			conn.recvMask = 0
+		}
+		conn.recvMax = counter
+		return true
+	}
+	diff := conn.recvMax - counter
+	if diff == 0 || diff > uint64(replayBits) || conn.recvMask&(1<<(diff-1)) != 0 {
+		return false
+	}
+	conn.recvMask |= 1 << (diff - 1)
+	return true
+}
+
+func (conn *Conn) open(body []byte) ([]byte, error) {
+	if len(body) < counterSize {
+		return nil, ErrDecrypt
+	}
+	counter := binary.BigEndian.Uint64(body[:counterSize])
+	plain, err := conn.recv.Open(conn.plain[:0], nonce(counter), body[counterSize:], body[:counterSize])
+	if err != nil {
+		return nil, ErrDecrypt
+	} else if !conn.checkReplay(counter) {
+		return nil, ErrReplay
+	}
+	conn.plain = plain // Keep grown buffer
+	return plain, nil
+}
+
+// Read decrypted data, invalid frames are dropped in datagram connections
+func (conn *Conn) Read(p []byte) (int, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+	buff := buffer.Get()
+	defer buffer.Put(buff)
+	for len(conn.pending) == 0 {
+		frameType, body, err := proto.ReadFrameBuffer(conn.reader, *buff)
+		if err != nil {
+			if conn.isPacket && isFrameError(err) {
+				conn.reader.Reset(conn.Conn) // Drop rest of datagram
+				continue
+			}
+			return 0, err
+		}
+
+		switch frameType {
+		case proto.FrameHandshake:
+			// Agent not recived reply, resend
+			if conn.reply != nil && bytes.Equal(body, conn.hello) {
+				conn.writeMu.Lock()
+				proto.WriteFrame(conn.Conn, proto.FrameHandshake, conn.reply)
+				conn.writeMu.Unlock()
+			}
+		case proto.FrameSealed:
+			if conn.pending, err = conn.open(body); err != nil && !conn.isPacket {
+				return 0, err
+			}
+		}
+	}
+	n := copy(p, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+// Seal data in one frame
+func (conn *Conn) Write(p []byte) (int, error) {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	conn.sendCount++
+	buff := buffer.Get()
+	defer buffer.Put(buff)
+	frame := binary.BigEndian.AppendUint64((*buff)[:proto.FrameHeaderSize], conn.sendCount)
+	frame = conn.send.Seal(frame, nonce(conn.sendCount), p, frame[proto.FrameHeaderSize:])
+	if err := proto.WriteFrameBuffer(conn.Conn, proto.FrameSealed, frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
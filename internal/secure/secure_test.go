@@ -0,0 +1,235 @@
+package secure
+
+import (
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/udplisterner"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
+)
+
+func generateKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Agent UDP socket and controller listener, peer is accepted after first datagram
+func udpPair(t *testing.T) (agent *net.UDPConn, accept func() net.Conn) {
+	ln, err := udplisterner.ListenConfig("udp", netip.MustParseAddrPort("127.0.0.1:0"), udplisterner.Config{Packet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if agent, err = net.DialUDP("udp", nil, ln.Addr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	return agent, func() net.Conn {
+		peer, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		t.Cleanup(func() { peer.Close() })
+		return peer
+	}
+}
+
+type result struct {
+	conn *Conn
+	err  error
+}
+
+// Run controller handshake in background
+func server(raw func() net.Conn, key *ecdh.PrivateKey) <-chan result {
+	done := make(chan result, 1)
+	go func() {
+		conn, err := Server(raw(), key, time.Second)
+		done <- result{conn, err}
+	}()
+	return done
+}
+
+// Sealed frame with counter, tampered frames have last tag byte changed
+func sealed(conn *Conn, counter uint64, data []byte, tamper bool) []byte {
+	frame := binary.BigEndian.AppendUint64(make([]byte, proto.FrameHeaderSize), counter)
+	frame = conn.send.Seal(frame, nonce(counter), data, frame[proto.FrameHeaderSize:])
+	if tamper {
+		frame[len(frame)-1] ^= 1
+	}
+	body := frame[proto.FrameHeaderSize:]
+	binary.BigEndian.PutUint32(frame[0:4], proto.FrameMagic)
+	frame[4], frame[5] = proto.FrameVersion, proto.FrameSealed
+	binary.BigEndian.PutUint32(frame[6:10], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[10:14], crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)))
+	return frame
+}
+
+func TestHandshake(t *testing.T) {
+	key := generateKey(t)
+	for name, pair := range map[string]func() (net.Conn, func() net.Conn){
+		"stream": func() (net.Conn, func() net.Conn) {
+			agent, controller := net.Pipe()
+			t.Cleanup(func() { agent.Close(); controller.Close() })
+			return agent, func() net.Conn { return controller }
+		},
+		"datagram": func() (net.Conn, func() net.Conn) {
+			agent, accept := udpPair(t)
+			return agent, accept
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			raw, accept := pair()
+			done := server(accept, key)
+			agent, err := Client(raw, key.PublicKey(), time.Second, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := <-done
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+
+			go agent.Write([]byte("agent to controller"))
+			buff := make([]byte, 64)
+			if n, err := res.conn.Read(buff); err != nil || string(buff[:n]) != "agent to controller" {
+				t.Fatalf("controller read %q, %v", buff[:n], err)
+			}
+			go res.conn.Write([]byte("controller to agent"))
+			if n, err := agent.Read(buff); err != nil || string(buff[:n]) != "controller to agent" {
+				t.Fatalf("agent read %q, %v", buff[:n], err)
+			}
+		})
+	}
+}
+
+func TestPinnedKeyMismatch(t *testing.T) {
+	key, pinned := generateKey(t), generateKey(t)
+	t.Run("stream", func(t *testing.T) {
+		agent, controller := net.Pipe()
+		defer agent.Close()
+		defer controller.Close()
+		server(func() net.Conn { return controller }, key)
+		if _, err := Client(agent, pinned.PublicKey(), time.Second, 3); err != ErrServerKey {
+			t.Fatalf("handshake with other controller key return %v", err)
+		}
+	})
+	t.Run("datagram", func(t *testing.T) {
+		agent, accept := udpPair(t)
+		server(accept, key)
+		start := time.Now()
+		if _, err := Client(agent, pinned.PublicKey(), 100*time.Millisecond, 2); err != ErrServerKey {
+			t.Fatalf("handshake with other controller key return %v", err)
+		} else if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Fatalf("handshake rejected after %s, before all attempts", elapsed)
+		}
+	})
+}
+
+// Spoofed reply to agent datagram socket is dropped and handshake continue with controller reply
+func TestSpoofedReply(t *testing.T) {
+	key := generateKey(t)
+	agent, accept := udpPair(t)
+	done := make(chan result, 1)
+	go func() {
+		peer := accept()
+		frameType, _, err := proto.ReadFrame(proto.NewDatagramReader(peer)) // First hello
+		if err != nil || frameType != proto.FrameHandshake {
+			done <- result{nil, errors.New("hello not recived")}
+			return
+		}
+		spoofed := make([]byte, KeySize+16)
+		spoofed[0] = 9
+		proto.WriteFrame(peer, proto.FrameHandshake, spoofed)
+		conn, err := Server(peer, key, time.Second) // Reply hello retransmission
+		done <- result{conn, err}
+	}()
+
+	if _, err := Client(agent, key.PublicKey(), 200*time.Millisecond, 3); err != nil {
+		t.Fatalf("handshake after spoofed reply: %v", err)
+	} else if res := <-done; res.err != nil {
+		t.Fatal(res.err)
+	}
+}
+
+func TestCheckReplay(t *testing.T) {
+	conn := &Conn{}
+	for _, test := range []struct {
+		counter uint64
+		valid   bool
+	}{
+		{0, false},  // Handshake counter
+		{1, true},   // First
+		{1, false},  // Duplicate
+		{5, true},   // Skip counters
+		{3, true},   // Reordered in window
+		{3, false},  // Reordered duplicate
+		{70, true},  // Window move
+		{5, false},  // Old, out of window
+		{6, true},   // Last counter in window
+		{6, false},  // Duplicate in window end
+		{69, true},  // Previous counter
+		{70, false}, // Duplicate max
+	} {
+		if valid := conn.checkReplay(test.counter); valid != test.valid {
+			t.Errorf("counter %d valid %v, expected %v", test.counter, valid, test.valid)
+		}
+	}
+}
+
+// Tampered and replayed frames are dropped in datagrams and close streams
+func TestTamperedFrame(t *testing.T) {
+	key := generateKey(t)
+	t.Run("datagram", func(t *testing.T) {
+		raw, accept := udpPair(t)
+		done := server(accept, key)
+		agent, err := Client(raw, key.PublicKey(), time.Second, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := <-done
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+
+		valid := sealed(agent, 2, []byte("valid"), false)
+		raw.Write(sealed(agent, 1, []byte("tampered"), true))
+		raw.Write(valid)
+		raw.Write(valid) // Replay
+		raw.Write(sealed(agent, 3, []byte("next"), false))
+		buff := make([]byte, 64)
+		for _, expected := range []string{"valid", "next"} {
+			res.conn.SetReadDeadline(time.Now().Add(time.Second))
+			if n, err := res.conn.Read(buff); err != nil || string(buff[:n]) != expected {
+				t.Fatalf("controller read %q, %v, expected %q", buff[:n], err, expected)
+			}
+		}
+	})
+	t.Run("stream", func(t *testing.T) {
+		raw, controller := net.Pipe()
+		defer raw.Close()
+		defer controller.Close()
+		done := server(func() net.Conn { return controller }, key)
+		agent, err := Client(raw, key.PublicKey(), time.Second, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := <-done
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		go raw.Write(sealed(agent, 1, []byte("tampered"), true))
+		if _, err := res.conn.Read(make([]byte, 64)); err != ErrDecrypt {
+			t.Fatalf("read tampered frame return %v", err)
+		}
+	})
+}
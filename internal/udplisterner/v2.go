@@ -1,37 +1,60 @@
 package udplisterner
 
 import (
-	"bufio"
-	"bytes"
+	"container/list"
 	"io"
-	"log"
 	"net"
 	"net/netip"
 	"sync"
+	"time"
 
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/batch"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/buffer"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pipe"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pmtu"
 )
 
+const (
+	peerBuffer    int = 0x40000 // Bytes waiting peer read, new datagrams are dropped if full
+	acceptBacklog int = 128     // Peers waiting Accept, datagrams from new peers are dropped if full
+)
+
+type Config struct {
+	IdleTimeout  time.Duration             // Close peer without datagrams in this time, zero disable
+	MaxPeers     int                       // Max peers, least recently used peer is closed on new peer, zero is unlimited
+	OnExpire     func(peer netip.AddrPort) // Called when peer is closed by idle timeout or eviction
+	DontFragment bool                      // Set don't fragment in socket, to path MTU discovery
+	Packet       bool                      // Peer Read return one datagram, false to read datagrams as stream like frames
+}
+
 type writeRoot struct {
-	conn *net.UDPConn
-	to   *net.UDPAddr
+	root *UDPServer
+	peer *client
 }
 
 func (wr *writeRoot) Write(w []byte) (int, error) {
-	return wr.conn.WriteToUDP(w, wr.to)
+	wr.root.touch(wr.peer)
+	return wr.root.writer.WriteTo(w, wr.peer.key) // Sent in batch with other peers datagrams
 }
 
 type client struct {
+	from                *net.UDPAddr
+	key                 netip.AddrPort // Peer address, key in peers
 	fromAgent, toClient net.Conn
-	bufferCache         *bytes.Buffer
-	bufioCache          *bufio.Reader
+	lastSeen            time.Time     // Last datagram recived or sent
+	lru                 *list.Element // Position in peers usage
 }
 
 type UDPServer struct {
-	rootUdp   *net.UDPConn       // Root connection to read
-	peers     map[string]*client // peers connected
+	rootUdp   *net.UDPConn               // Root connection to read
+	batch     *batch.PacketConn          // Batched reads from root connection
+	writer    *batch.Writer              // Batched writes from all peers
+	peers     map[netip.AddrPort]*client // peers connected
+	lru       *list.List                 // Peers by last usage, front is most recent
 	newPeer   chan net.Conn
 	peerError chan error
+	config    Config
+	done      chan struct{} // Closed with listener
 
 	closed bool
 	rw     sync.RWMutex
@@ -44,17 +67,18 @@ func (udpListen *UDPServer) Addr() net.Addr {
 
 // Close peers and root connection
 func (udpListen *UDPServer) Close() error {
+	udpListen.rw.Lock()
 	if udpListen.closed {
+		udpListen.rw.Unlock()
 		return io.ErrClosedPipe
 	}
 	udpListen.closed = true
-	for peerIndex := range udpListen.peers {
-		log.Printf("closing %s", peerIndex)
-		udpListen.peers[peerIndex].fromAgent.Close() // Close
-		log.Printf("clearing %s", peerIndex)
-		udpListen.peers[peerIndex].bufferCache.Reset()
+	close(udpListen.done)
+	for _, peer := range udpListen.peers {
+		udpListen.remove(peer)
 	}
-	log.Printf("closing udp root")
+	udpListen.rw.Unlock()
+	udpListen.writer.Close()
 	return udpListen.rootUdp.Close()
 }
 
@@ -65,66 +89,162 @@ func (udpListen *UDPServer) Accept() (peer net.Conn, err error) {
 		return
 	case err = <-udpListen.peerError:
 		return
+	case <-udpListen.done:
+		return nil, net.ErrClosed
 	}
 }
 
-func (udpListen *UDPServer) handler() {
+// Mark peer as recently used
+func (udpListen *UDPServer) touch(peer *client) {
+	udpListen.rw.Lock()
+	defer udpListen.rw.Unlock()
+	if udpListen.peers[peer.key] == peer {
+		peer.lastSeen = time.Now()
+		udpListen.lru.MoveToFront(peer.lru)
+	}
+}
+
+// Remove peer and close pipe, caller must hold lock
+func (udpListen *UDPServer) remove(peer *client) {
+	delete(udpListen.peers, peer.key)
+	udpListen.lru.Remove(peer.lru)
+	peer.fromAgent.Close()
+}
+
+// Remove peer and notify expire callback, caller must hold lock
+func (udpListen *UDPServer) expire(peer *client) {
+	udpListen.remove(peer)
+	if udpListen.config.OnExpire != nil {
+		go udpListen.config.OnExpire(peer.key)
+	}
+}
+
+// Close peers without datagrams in idle timeout
+func (udpListen *UDPServer) reaper() {
+	ticker := time.NewTicker(max(udpListen.config.IdleTimeout/4, time.Second))
+	defer ticker.Stop()
 	for {
-		buff := make([]byte, 1480)
-		n, from, err := udpListen.rootUdp.ReadFromUDP(buff)
-		if err != nil {
+		select {
+		case <-udpListen.done:
 			return
+		case <-ticker.C:
+		}
+		udpListen.rw.Lock()
+		for last := udpListen.lru.Back(); last != nil; last = udpListen.lru.Back() {
+			peer := last.Value.(*client)
+			if time.Since(peer.lastSeen) < udpListen.config.IdleTimeout {
+				break // Next peers are most recent
+			}
+			udpListen.expire(peer)
 		}
+		udpListen.rw.Unlock()
+	}
+}
+
+// Register peer and queue to Accept, return nil if backlog is full. Caller must hold lock
+func (udpListen *UDPServer) newClient(key netip.AddrPort) *client {
+	if len(udpListen.newPeer) == cap(udpListen.newPeer) {
+		return nil // Accept not keeping up, peer retry like TCP SYN
+	}
+	if udpListen.config.MaxPeers > 0 && len(udpListen.peers) >= udpListen.config.MaxPeers {
+		udpListen.expire(udpListen.lru.Back().Value.(*client)) // Evict least recently used
+	}
+
+	from := net.UDPAddrFromAddrPort(key)
+	c := &client{from: from, key: key, lastSeen: time.Now()}
+	c.fromAgent, c.toClient = pipe.CreateBufferedPipe(from, from, pipe.BufferConfig{
+		Capacity: peerBuffer,
+		Packet:   udpListen.config.Packet,
+		Drop:     true, // Peer not reading, drop datagram and not block other peers
+	})
+	c.lru = udpListen.lru.PushFront(c)
+	udpListen.peers[key] = c
+	udpListen.newPeer <- c.toClient // Only sender, space checked with lock
 
+	go func() {
+		io.CopyBuffer(&writeRoot{udpListen, c}, c.fromAgent, make([]byte, 0xffff)) // Read full datagram
 		udpListen.rw.Lock()
-		if _, exist := udpListen.peers[from.String()]; !exist {
-			c := new(client)
+		if udpListen.peers[key] == c {
+			udpListen.remove(c) // Peer closed by Accept side
+		}
+		udpListen.rw.Unlock()
+	}()
+	return c
+}
 
-			c.bufferCache = new(bytes.Buffer)
-			c.bufioCache = bufio.NewReader(c.bufferCache)
+func (udpListen *UDPServer) handler() {
+	msgs, buffs := make([]batch.Message, batch.Size), make([]*[]byte, batch.Size)
+	for index := range msgs {
+		buffs[index] = buffer.Get() // Fit max UDP datagram size
+		msgs[index].Buffer = *buffs[index]
+	}
+	defer func() {
+		for _, buff := range buffs {
+			buffer.Put(buff)
+		}
+	}()
 
-			c.fromAgent, c.toClient = pipe.CreatePipe(from, from)
+	for {
+		n, err := udpListen.batch.ReadBatch(msgs)
+		if err != nil {
+			return
+		}
 
-			udpListen.peers[from.String()] = c
-			go func(){
-				for _, exist := udpListen.peers[from.String()]; exist; {
-					io.Copy(c.fromAgent, c.bufioCache)
+		udpListen.rw.Lock()
+		if udpListen.closed {
+			udpListen.rw.Unlock()
+			return
+		}
+		for index := range msgs[:n] {
+			c, exist := udpListen.peers[msgs[index].Addr]
+			if !exist {
+				if c = udpListen.newClient(msgs[index].Addr); c == nil {
+					continue
 				}
-			}()
-
-			go func() {
-				udpListen.newPeer <- c.toClient
-				io.Copy(&writeRoot{udpListen.rootUdp, from}, c.fromAgent)
-				udpListen.rw.Lock()
-				delete(udpListen.peers, from.String())
-				udpListen.rw.Unlock()
-			}()
+			}
+			c.lastSeen = time.Now()
+			udpListen.lru.MoveToFront(c.lru)
+			c.fromAgent.Write(msgs[index].Buffer[:msgs[index].N]) // Copy to peer buffer, not wait peer read
 		}
-
 		udpListen.rw.Unlock()
-		udpListen.rw.RLock()
-		udpListen.peers[from.String()].bufferCache.Write(buff[:n])
-		udpListen.rw.RUnlock()
 	}
 }
 
-func listenRoot(network string, laddr *net.UDPAddr) (net.Listener, error) {
+func listenRoot(network string, laddr *net.UDPAddr, config Config) (net.Listener, error) {
 	conn, err := net.ListenUDP(network, laddr)
 	if err != nil {
 		return nil, err
+	} else if config.DontFragment {
+		if err = pmtu.SetDontFragment(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 	var root = &UDPServer{
 		rootUdp:   conn,
-		peers:     make(map[string]*client),
-		newPeer:   make(chan net.Conn),
+		batch:     batch.NewPacketConn(conn),
+		peers:     make(map[netip.AddrPort]*client),
+		lru:       list.New(),
+		newPeer:   make(chan net.Conn, acceptBacklog),
 		peerError: make(chan error),
+		config:    config,
+		done:      make(chan struct{}),
 	}
+	root.writer = batch.NewWriter(root.batch)
 	go root.handler()
+	if config.IdleTimeout > 0 {
+		go root.reaper()
+	}
 	return root, nil
 }
 
 func ListenAddrPort(Network string, address netip.AddrPort) (net.Listener, error) {
-	return listenRoot(Network, net.UDPAddrFromAddrPort(address))
+	return listenRoot(Network, net.UDPAddrFromAddrPort(address), Config{})
+}
+
+// Listen with peers idle timeout and limit
+func ListenConfig(Network string, address netip.AddrPort, config Config) (net.Listener, error) {
+	return listenRoot(Network, net.UDPAddrFromAddrPort(address), config)
 }
 
 func Listen(Network, address string) (net.Listener, error) {
@@ -132,5 +252,5 @@ func Listen(Network, address string) (net.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return listenRoot(Network, ip)
+	return listenRoot(Network, ip, Config{})
 }
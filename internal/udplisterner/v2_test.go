@@ -0,0 +1,83 @@
+package udplisterner
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// Each peer Read return one datagram, sent back to back by peer
+func TestPacketRead(t *testing.T) {
+	ln, err := ListenConfig("udp", netip.MustParseAddrPort("127.0.0.1:0"), Config{Packet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.DialUDP("udp", nil, ln.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sizes := []int{100, 1, 1400, 50}
+	for index, size := range sizes {
+		conn.Write(bytes.Repeat([]byte{byte(index)}, size))
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 0xffff)
+	for index, size := range sizes {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := peer.Read(buff); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buff[:n], bytes.Repeat([]byte{byte(index)}, size)) {
+			t.Fatalf("read %d return %d bytes, expected datagram with %d bytes", index, n, size)
+		}
+	}
+}
+
+// Peers above backlog are not registered while Accept not run, and register on retry
+func TestAcceptBacklog(t *testing.T) {
+	ln, err := ListenConfig("udp", netip.MustParseAddrPort("127.0.0.1:0"), Config{Packet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	root := ln.(*UDPServer)
+
+	conns := make([]*net.UDPConn, acceptBacklog+10)
+	for index := range conns {
+		if conns[index], err = net.DialUDP("udp", nil, ln.Addr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[index].Close()
+		conns[index].Write([]byte("hello"))
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(root.newPeer) < acceptBacklog && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	root.rw.RLock()
+	peers := len(root.peers)
+	root.rw.RUnlock()
+	if peers != acceptBacklog {
+		t.Fatalf("%d peers registered with backlog %d", peers, acceptBacklog)
+	}
+
+	for index := 0; index < acceptBacklog; index++ {
+		if _, err := ln.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conns[len(conns)-1].Write([]byte("retry"))
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	} else if peer.RemoteAddr().String() != conns[len(conns)-1].LocalAddr().String() {
+		t.Fatalf("accepted %s, expected peer retry %s", peer.RemoteAddr(), conns[len(conns)-1].LocalAddr())
+	}
+}
@@ -0,0 +1,184 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/buffer"
+)
+
+const (
+	FrameMagic      uint32 = 0x50505854 // "PPXT"
+	FrameVersion    uint8  = 1          // Current frame envelope version
+	FrameHeaderSize int    = 14         // Magic, version, type, length and CRC
+
+	FrameRequest   uint8 = 1 // Frame body is Request
+	FrameResponse  uint8 = 2 // Frame body is Response
+	FrameHandshake uint8 = 3 // Frame body is secure handshake
+	FrameSealed    uint8 = 4 // Frame body is encrypted Request or Response frame
+
+	MaxFrameSize uint32 = 0xffff // Max body size, fit any UDP datagram
+)
+
+var (
+	ErrFrameMagic     error = errors.New("invalid frame magic")                      // Stream is out of sync, cannot read next frames
+	ErrFrameVersion   error = errors.New("frame version not supported")              // Frame body is discarded
+	ErrFrameType      error = errors.New("unexpected frame type")                    // Frame body is discarded
+	ErrFrameTruncated error = errors.New("frame truncated")                          // Reader end before full frame
+	ErrFrameOversized error = errors.New("frame body is bigger than max frame size") // Body not written or read
+	ErrFrameChecksum  error = errors.New("frame checksum mismatch")                  // Frame body is corrupted and discarded
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Check if error is frame or body error and reader can continue to next frame
+func IsFrameSkippable(err error) bool {
+	return errors.Is(err, ErrInvalidBody) || errors.Is(err, ErrFrameVersion) || errors.Is(err, ErrFrameType) || errors.Is(err, ErrFrameChecksum)
+}
+
+// Write body in frame envelope with single Write call
+func WriteFrame(w io.Writer, Type uint8, body []byte) error {
+	if uint64(len(body)) > uint64(MaxFrameSize) {
+		return ErrFrameOversized
+	}
+	buff := buffer.Get()
+	defer buffer.Put(buff)
+	return WriteFrameBuffer(w, Type, append((*buff)[:FrameHeaderSize], body...))
+}
+
+// Write frame with body appended after FrameHeaderSize bytes reserved to header,
+// header is set in frame so body is not copied
+func WriteFrameBuffer(w io.Writer, Type uint8, frame []byte) error {
+	body := frame[FrameHeaderSize:]
+	if uint64(len(body)) > uint64(MaxFrameSize) {
+		return ErrFrameOversized
+	}
+	binary.BigEndian.PutUint32(frame[0:4], FrameMagic)
+	frame[4] = FrameVersion
+	frame[5] = Type
+	binary.BigEndian.PutUint32(frame[6:10], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[10:14], crc32.Checksum(body, crcTable))
+	_, err := w.Write(frame)
+	return err
+}
+
+// Read next frame envelope and return type and body
+func ReadFrame(r io.Reader) (Type uint8, body []byte, err error) {
+	return ReadFrameBuffer(r, nil)
+}
+
+// Read next frame envelope to buff, body is slice of buff if frame fit or new slice
+func ReadFrameBuffer(r io.Reader, buff []byte) (Type uint8, body []byte, err error) {
+	if len(buff) < FrameHeaderSize {
+		buff = make([]byte, FrameHeaderSize)
+	}
+	header := buff[:FrameHeaderSize]
+	if _, err = io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrFrameTruncated
+		}
+		return
+	} else if binary.BigEndian.Uint32(header[0:4]) != FrameMagic {
+		return 0, nil, ErrFrameMagic
+	}
+
+	size := binary.BigEndian.Uint32(header[6:10])
+	if size > MaxFrameSize {
+		return 0, nil, ErrFrameOversized
+	} else if len(buff)-FrameHeaderSize >= int(size) {
+		body = buff[FrameHeaderSize : FrameHeaderSize+int(size)]
+	} else {
+		body = make([]byte, size)
+	}
+	if _, err = io.ReadFull(r, body); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrFrameTruncated
+		}
+		return 0, nil, err
+	} else if header[4] != FrameVersion {
+		return 0, nil, ErrFrameVersion
+	} else if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[10:14]) {
+		return 0, nil, ErrFrameChecksum
+	}
+	return header[5], body, nil
+}
+
+// Buffered reader to frames, Reset drop data buffered and read next from r
+type FrameReader interface {
+	io.Reader
+	Reset(r io.Reader)
+}
+
+// Read frames from datagrams, frame not continue in next datagram so truncated datagram
+// return ErrFrameTruncated in ReadFrame and Reset drop rest of invalid datagram
+type DatagramReader struct {
+	r     io.Reader
+	buff  []byte
+	data  []byte // Rest of current datagram
+	short bool   // Last Read ended datagram before fill buffer
+}
+
+func NewDatagramReader(r io.Reader) *DatagramReader {
+	return &DatagramReader{r: r, buff: make([]byte, buffer.Size)}
+}
+
+func (reader *DatagramReader) Read(p []byte) (int, error) {
+	if len(reader.data) == 0 {
+		if reader.short {
+			reader.short = false
+			return 0, io.ErrUnexpectedEOF // Frame bigger than rest of datagram
+		}
+		n, err := reader.r.Read(reader.buff)
+		if err != nil {
+			return 0, err
+		}
+		reader.data = reader.buff[:n]
+	}
+	n := copy(p, reader.data)
+	reader.data = reader.data[n:]
+	reader.short = n < len(p)
+	return n, nil
+}
+
+// Drop rest of current datagram and read next datagrams from r
+func (reader *DatagramReader) Reset(r io.Reader) {
+	reader.r, reader.data, reader.short = r, nil, false
+}
+
+type frameBody interface {
+	Unmarshal(b []byte) error
+	detach() // Copy data sliced from frame buffer
+}
+
+type frameMarshaler interface {
+	MarshalAppend(b []byte) ([]byte, error)
+}
+
+// Encode body in pooled buffer and write in frame
+func writeFrameBody(w io.Writer, Type uint8, body frameMarshaler) error {
+	buff := buffer.Get()
+	defer buffer.Put(buff)
+	frame, err := body.MarshalAppend((*buff)[:FrameHeaderSize])
+	if err != nil {
+		return err
+	}
+	return WriteFrameBuffer(w, Type, frame)
+}
+
+// Decode frame body read in pooled buffer, body must be consumed complete
+func readFrameBody(r io.Reader, Type uint8, body frameBody) error {
+	buff := buffer.Get()
+	defer buffer.Put(buff)
+	frameType, frame, err := ReadFrameBuffer(r, *buff)
+	if err != nil {
+		return err
+	} else if frameType != Type {
+		return ErrFrameType
+	} else if err = body.Unmarshal(frame); err != nil {
+		return err
+	}
+	body.detach()
+	return nil
+}
@@ -0,0 +1,86 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func FuzzReadFrame(f *testing.F) {
+	var frame bytes.Buffer
+	WriteFrame(&frame, FrameRequest, []byte("body"))
+	WriteFrame(&frame, FrameResponse, nil)
+	f.Add(frame.Bytes())
+	f.Add(frame.Bytes()[:FrameHeaderSize])
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frameType, body, err := ReadFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		var out bytes.Buffer
+		if err := WriteFrame(&out, frameType, body); err != nil {
+			t.Fatalf("write frame read: %s", err)
+		} else if !bytes.HasPrefix(data, out.Bytes()) {
+			t.Fatalf("frame %x written as %x", data[:out.Len()], out.Bytes())
+		}
+	})
+}
+
+func TestDatagramReader(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		defer remote.Close()
+		WriteFrame(remote, FrameRequest, []byte("a"))
+		remote.Write([]byte("garbage")) // Shorter than header
+		WriteFrame(remote, FrameRequest, []byte("b"))
+	}()
+
+	reader := NewDatagramReader(local)
+	var got []byte
+	for {
+		_, body, err := ReadFrame(reader)
+		if errors.Is(err, ErrFrameTruncated) || errors.Is(err, ErrFrameMagic) {
+			reader.Reset(local) // Drop rest of datagram
+			continue
+		} else if err != nil {
+			break
+		}
+		got = append(got, body...)
+	}
+	if string(got) != "ab" {
+		t.Fatalf("frames read %q, want %q", got, "ab")
+	}
+}
+
+// Frame write with pooled buffer, body is encoded in place
+func BenchmarkWriteRequest(b *testing.B) {
+	req := Request{DataTX: &ClientData{Client: testClient, Seq: 9, Size: uint64(len(benchData)), Data: benchData}}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		if err := WriteRequest(io.Discard, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Frame read with pooled buffer, data is copied out of buffer
+func BenchmarkReaderRequest(b *testing.B) {
+	var frame bytes.Buffer
+	if err := WriteRequest(&frame, Request{DataTX: &ClientData{Client: testClient, Seq: 9, Size: uint64(len(benchData)), Data: benchData}}); err != nil {
+		b.Fatal(err)
+	}
+	r := bytes.NewReader(frame.Bytes())
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		r.Reset(frame.Bytes())
+		if _, err := ReaderRequest(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -14,100 +14,461 @@ const (
 	ProtoUDP  uint8 = 2 // UDP Protocol
 	ProtoBoth uint8 = 3 // TCP+UDP Protocol
 
-	DataSize       uint64 = 10_000                // Default listener data recive and send
-	PacketSize     uint64 = 800                   // Packet to without data only requests and response headers
-	PacketDataSize uint64 = DataSize + PacketSize // Header and Data request/response
+	MinDatagramSize uint16 = 1200       // Datagram size all paths support, used before path MTU discovery
+	MaxDatagramSize uint16 = 16 * 1024  // Largest datagram probed and datagram size to stream transports
+	DataOverhead    uint16 = 128        // Max bytes of frames, encryption and headers around ClientData data
+	MaxDataSize     uint64 = 0xffff     // Max client data in one ClientData or reassembled from fragments
+	MaxFragments    uint8  = 64         // Max fragments to one ClientData, fit MaxDataSize in MinDatagramSize
+	InitialWindow   uint64 = 256 * 1024 // Bytes stream can send before first window update
+
+	ProtocolVersion    uint16 = 5 // Current protocol version
+	MinProtocolVersion uint16 = 2 // Oldest protocol version supported
+	VersionRequestID   uint16 = 3 // Peer decode request IDs
+	VersionError       uint16 = 3 // Peer decode Error, older peers get Unauthorized, BadRequest and NotListening
+	VersionCloseReason uint16 = 4 // Peer decode ClientClose.Reason
+	VersionCloseKind   uint16 = 5 // Peer decode ClientClose.Kind and shutdown write
+
+	FlagRequestID uint64 = 1 << 63 // Set in request and response type when request ID follow type
+
+	TransportAuto string = "auto" // Try UDP and fallback to TCP if handshake timeout
+	TransportUDP  string = "udp"  // Controller over UDP datagrams
+	TransportTCP  string = "tcp"  // Controller over TCP stream
+	TransportTLS  string = "tls"  // Controller over TLS stream
+)
+
+// Capabilities flags in Hello, negotiated capabilities are flags both sides support
+const (
+	CapEncryption  uint64 = 1 << iota // Connection encrypted with controller key
+	CapCompression                    // Compressed client data, reserved
+	CapMappings                       // Many mappings in one tunnel
+	CapResume                         // Resume session after reconnect
+	CapFlowControl                    // Stream window updates
+	CapPathMTU                        // Path MTU discovery and ClientData fragments
+	CapNewClient                      // Controller announce clients on accept
 )
 
 var (
 	ErrInvalidBody error = errors.New("invalid body, check request/response")
 )
 
-type Client struct {
-	Client netip.AddrPort // Client address and port
-	Proto  uint8          // Protocol to close (proto.ProtoTCP, proto.ProtoUDP or proto.ProtoBoth)
+// Version and features, agent send before auth and controller reply with negotiated values
+type Hello struct {
+	Version      uint16 // Agent: max version supported, Controller: version negotiated
+	MinVersion   uint16 // Oldest version supported
+	Capabilities uint64 // Agent: features supported, Controller: features both support
+	Software     string // Agent or controller version string
+	OS, Arch     string // runtime.GOOS and runtime.GOARCH
 }
 
-func (close Client) Writer(w io.Writer) error {
-	addr := close.Client.Addr()
-	if !addr.IsValid() {
-		return fmt.Errorf("invalid ip address")
+// Check if capability is set
+func (hello Hello) Has(capability uint64) bool {
+	return hello.Capabilities&capability == capability
+}
+
+// Highest version and capabilities both sides support, ok is false if version ranges not overlap
+func Negotiate(agent, controller Hello) (version uint16, capabilities uint64, ok bool) {
+	version = min(agent.Version, controller.Version)
+	if version < max(agent.MinVersion, controller.MinVersion) {
+		return 0, 0, false
 	}
+	return version, agent.Capabilities & controller.Capabilities, true
+}
 
-	var family uint8 = 6
-	if addr.Is4() {
-		family = 4
+func (hello Hello) MarshalAppend(b []byte) ([]byte, error) {
+	b = bigendian.AppendUint16(b, hello.Version)
+	b = bigendian.AppendUint16(b, hello.MinVersion)
+	b = bigendian.AppendUint64(b, hello.Capabilities)
+	b = appendString8(b, hello.Software)
+	b = appendString8(b, hello.OS)
+	return appendString8(b, hello.Arch), nil
+}
+func (hello *Hello) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, hello.decode(&r))
+}
+func (hello *Hello) decode(r *bigendian.Reader) (err error) {
+	if hello.Version, err = r.Uint16(); err != nil {
+		return
+	} else if hello.MinVersion, err = r.Uint16(); err != nil {
+		return
+	} else if hello.Capabilities, err = r.Uint64(); err != nil {
+		return
+	} else if hello.Software, err = readString8(r); err != nil {
+		return
+	} else if hello.OS, err = readString8(r); err != nil {
+		return
 	}
+	hello.Arch, err = readString8(r)
+	return
+}
 
-	if err := bigendian.WriteUint8(w, close.Proto); err != nil {
-		return err
-	} else if err := bigendian.WriteUint8(w, family); err != nil {
-		return err
-	} else if err := bigendian.WriteBytes(w, addr.AsSlice()); err != nil {
-		return err
-	} else if err := bigendian.WriteUint16(w, close.Client.Port()); err != nil {
-		return err
+// Append string with uint8 size, bigger string is truncated
+func appendString8(b []byte, value string) []byte {
+	if len(value) > 0xff {
+		value = value[:0xff]
 	}
-	return nil
+	return append(bigendian.AppendUint8(b, uint8(len(value))), value...)
 }
-func (close *Client) Reader(r io.Reader) (err error) {
-	if close.Proto, err = bigendian.ReadUint8(r); err != nil {
-		return
+func readString8(r *bigendian.Reader) (string, error) {
+	size, err := r.Uint8()
+	if err != nil {
+		return "", err
 	}
-	family, err := bigendian.ReadUint8(r)
+	value, err := r.Bytes(uint64(size))
+	return string(value), err
+}
+
+// Append string with uint16 size, bigger string is truncated
+func appendString16(b []byte, value string) []byte {
+	if len(value) > 0xffff {
+		value = value[:0xffff]
+	}
+	return append(bigendian.AppendUint16(b, uint16(len(value))), value...)
+}
+func readString16(r *bigendian.Reader) (string, error) {
+	size, err := r.Uint16()
 	if err != nil {
+		return "", err
+	}
+	value, err := r.Bytes(uint64(size))
+	return string(value), err
+}
+
+// Append request or response type, request ID only if set so frames without ID are same as protocol 2
+func appendType(b []byte, Type uint64, ID uint32) []byte {
+	if ID == 0 {
+		return bigendian.AppendUint64(b, Type)
+	}
+	return bigendian.AppendUint32(bigendian.AppendUint64(b, Type|FlagRequestID), ID)
+}
+func readType(r *bigendian.Reader) (Type uint64, ID uint32, err error) {
+	if Type, err = r.Uint64(); err != nil || Type&FlagRequestID == 0 {
+		return
+	}
+	ID, err = r.Uint32()
+	return Type &^ FlagRequestID, ID, err
+}
+
+// Check decode error and if body is consumed complete
+func decoded(r *bigendian.Reader, err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return ErrInvalidBody
+	} else if err != nil {
 		return err
+	} else if r.Len() > 0 {
+		return ErrInvalidBody
+	}
+	return nil
+}
+
+type Client struct {
+	Client  netip.AddrPort // Client address and port
+	Proto   uint8          // Protocol to close (proto.ProtoTCP, proto.ProtoUDP or proto.ProtoBoth)
+	Mapping uint16         // Mapping ID client connected
+}
+
+// Unique client key in tunnel, same address can connect to many mappings
+func (client Client) Key() string {
+	return fmt.Sprintf("%d/%s", client.Mapping, client.Client)
+}
+
+func (close Client) MarshalAppend(b []byte) ([]byte, error) {
+	addr := close.Client.Addr()
+	if !addr.IsValid() {
+		return b, fmt.Errorf("invalid ip address")
+	}
+
+	b = bigendian.AppendUint8(b, close.Proto)
+	b = bigendian.AppendUint16(b, close.Mapping)
+	if addr.Is4() {
+		ip := addr.As4()
+		b = append(bigendian.AppendUint8(b, 4), ip[:]...)
+	} else {
+		ip := addr.As16()
+		b = append(bigendian.AppendUint8(b, 6), ip[:]...)
+	}
+	return bigendian.AppendUint16(b, close.Client.Port()), nil
+}
+func (close *Client) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, close.decode(&r))
+}
+func (close *Client) decode(r *bigendian.Reader) (err error) {
+	var family uint8
+	var port uint16
+	if close.Proto, err = r.Uint8(); err != nil {
+		return
+	} else if close.Mapping, err = r.Uint16(); err != nil {
+		return
+	} else if family, err = r.Uint8(); err != nil {
+		return
 	}
 
 	var addr netip.Addr
 	if family == 4 {
-		buff, err := bigendian.ReadBytesN(r, 4)
-		if err != nil {
-			return err
+		var ip [4]byte
+		if err = r.ReadFull(ip[:]); err != nil {
+			return
 		}
-		addr = netip.AddrFrom4([4]byte(buff))
+		addr = netip.AddrFrom4(ip)
 	} else {
-		buff, err := bigendian.ReadBytesN(r, 16)
-		if err != nil {
-			return err
+		var ip [16]byte
+		if err = r.ReadFull(ip[:]); err != nil {
+			return
 		}
-		addr = netip.AddrFrom16([16]byte(buff))
+		addr = netip.AddrFrom16(ip)
 	}
 
-	port, err := bigendian.ReadUint16(r)
-	if err != nil {
-		return err
+	if port, err = r.Uint16(); err != nil {
+		return
 	}
 	close.Client = netip.AddrPortFrom(addr, port)
 	return
 }
 
+const (
+	CloseFull  uint8 = 0 // Client closed, peer flush data and close connection
+	CloseWrite uint8 = 1 // Client not send more data, peer shutdown write after flush data
+	CloseAbort uint8 = 2 // Client connection reset, peer drop data and reset connection
+)
+
+// Close client, agent send reason when cannot dial client target.
+// Reason and Kind are encoded only if set, so full close is same as protocol 2
+type ClientClose struct {
+	Client Client // Client to close
+	Kind   uint8  // CloseFull, CloseWrite or CloseAbort, TCP only
+	Reason string // Dial error, empty if client closed normally
+}
+
+// Drop fields peer with negotiated version cannot decode, write shutdown and reset are full close to old peers
+func (close ClientClose) For(version uint16) ClientClose {
+	if version < VersionCloseKind {
+		close.Kind = CloseFull
+	}
+	if version < VersionCloseReason {
+		close.Reason = ""
+	}
+	return close
+}
+
+func (close ClientClose) MarshalAppend(b []byte) (_ []byte, err error) {
+	if close.Kind > CloseAbort {
+		return b, ErrInvalidBody
+	} else if b, err = close.Client.MarshalAppend(b); err != nil {
+		return
+	} else if close.Reason == "" && close.Kind == CloseFull {
+		return b, nil
+	}
+	b = appendString16(b, close.Reason)
+	if close.Kind == CloseFull {
+		return b, nil
+	}
+	return bigendian.AppendUint8(b, close.Kind), nil
+}
+func (close *ClientClose) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, close.decode(&r))
+}
+func (close *ClientClose) decode(r *bigendian.Reader) (err error) {
+	if err = close.Client.decode(r); err != nil || r.Len() == 0 {
+		return
+	} else if close.Reason, err = readString16(r); err != nil || r.Len() == 0 {
+		return
+	} else if close.Kind, err = r.Uint8(); err != nil {
+		return
+	} else if close.Kind > CloseAbort {
+		return ErrInvalidBody
+	}
+	return
+}
+
+// Port listened in controller and redirected to agent target
+type Mapping struct {
+	ID    uint16 // Mapping ID sent in Client
+	Name  string // Agent target name
+	Proto uint8  // Protocol listened (proto.ProtoTCP, proto.ProtoUDP or proto.ProtoBoth)
+	Port  uint16 // Controller port listened
+}
+
+func (mapping Mapping) MarshalAppend(b []byte) ([]byte, error) {
+	b = bigendian.AppendUint16(b, mapping.ID)
+	b = bigendian.AppendUint8(b, mapping.Proto)
+	b = bigendian.AppendUint16(b, mapping.Port)
+	return appendString8(b, mapping.Name), nil
+}
+func (mapping *Mapping) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, mapping.decode(&r))
+}
+func (mapping *Mapping) decode(r *bigendian.Reader) (err error) {
+	if mapping.ID, err = r.Uint16(); err != nil {
+		return
+	} else if mapping.Proto, err = r.Uint8(); err != nil {
+		return
+	} else if mapping.Port, err = r.Uint16(); err != nil {
+		return
+	}
+	mapping.Name, err = readString8(r)
+	return
+}
+
+// ClientData bigger than path MTU is split in fragments with same ID
+type Fragment struct {
+	ID    uint32 // Fragmented data ID, unique to sender
+	Index uint8  // Fragment position
+	Count uint8  // Fragments to reassemble data, 0 or 1 is not fragmented
+}
+
+func (frag Fragment) MarshalAppend(b []byte) ([]byte, error) {
+	b = bigendian.AppendUint32(b, frag.ID)
+	b = bigendian.AppendUint8(b, frag.Index)
+	return bigendian.AppendUint8(b, frag.Count), nil
+}
+func (frag *Fragment) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, frag.decode(&r))
+}
+func (frag *Fragment) decode(r *bigendian.Reader) (err error) {
+	if frag.ID, err = r.Uint32(); err != nil {
+		return
+	} else if frag.Index, err = r.Uint8(); err != nil {
+		return
+	} else if frag.Count, err = r.Uint8(); err != nil {
+		return
+	} else if frag.Count > MaxFragments || (frag.Count > 1 && frag.Index >= frag.Count) {
+		return ErrInvalidBody
+	}
+	return
+}
+
 type ClientData struct {
-	Client Client // Client Destination
-	Size   uint64 // Data size
-	Data   []byte `json:"-"` // Bytes to send
+	Client   Client   // Client Destination
+	Seq      uint64   // Stream sequence, 0 to unsequenced data (UDP)
+	Fragment Fragment // Fragment of data, Seq and Client are same in all fragments
+	Size     uint64   // Data size
+	Data     []byte   `json:"-"` // Bytes to send
 }
 
-func (data ClientData) Writer(w io.Writer) error {
-	if err := data.Client.Writer(w); err != nil {
-		return err
-	} else if err := bigendian.WriteUint64(w, data.Size); err != nil {
-		return err
-	} else if _, err := w.Write(data.Data[:data.Size]); err != nil { // Write data without convert to big-endian
-		return err
+func (data ClientData) MarshalAppend(b []byte) (_ []byte, err error) {
+	if b, err = data.Client.MarshalAppend(b); err != nil {
+		return
+	} else if b, err = data.Fragment.MarshalAppend(bigendian.AppendUint64(b, data.Seq)); err != nil {
+		return
 	}
-	return nil
+	b = bigendian.AppendUint64(b, data.Size)
+	return append(b, data.Data[:data.Size]...), nil // Append data without convert to big-endian
+}
+
+// Decode data, Data is slice of b and must be copied before reuse b
+func (data *ClientData) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, data.decode(&r))
+}
+func (data *ClientData) decode(r *bigendian.Reader) (err error) {
+	if err = data.Client.decode(r); err != nil {
+		return
+	} else if data.Seq, err = r.Uint64(); err != nil {
+		return
+	} else if err = data.Fragment.decode(r); err != nil {
+		return
+	} else if data.Size, err = r.Uint64(); err != nil {
+		return
+	} else if data.Size > MaxDataSize {
+		return ErrInvalidBody
+	}
+	data.Data, err = r.Bytes(data.Size)
+	return
+}
+
+// Path MTU probe, probe is padded to Size and other side echo it with same padding.
+// After discovery agent send largest size echoed without probe.
+type PathMTU struct {
+	Size  uint16 // Datagram size
+	Probe bool   // Request echo padded to Size
+}
+
+func (mtu PathMTU) MarshalAppend(b []byte) ([]byte, error) {
+	if mtu.Size < MinDatagramSize || mtu.Size > MaxDatagramSize {
+		return b, ErrInvalidBody // Same range of decode, padding is Size less overhead
+	}
+	b = bigendian.AppendUint16(b, mtu.Size)
+	if !mtu.Probe {
+		return bigendian.AppendUint8(b, 0), nil
+	}
+	b = bigendian.AppendUint8(b, 1)
+	return append(b, make([]byte, mtu.Size-DataOverhead)...), nil // Padding, frame fit in Size like ClientData
+}
+func (mtu *PathMTU) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, mtu.decode(&r))
+}
+func (mtu *PathMTU) decode(r *bigendian.Reader) (err error) {
+	if mtu.Size, err = r.Uint16(); err != nil {
+		return
+	} else if mtu.Size < MinDatagramSize || mtu.Size > MaxDatagramSize {
+		return ErrInvalidBody
+	}
+	probe, err := r.Uint8()
+	if mtu.Probe = probe == 1; err != nil || !mtu.Probe {
+		return
+	}
+	_, err = r.Bytes(uint64(mtu.Size - DataOverhead)) // Discard padding
+	return
+}
+
+// Stream flow control window, limit is absolute so lost or reordered updates are not a problem
+type WindowUpdate struct {
+	Client Client // Client stream
+	Limit  uint64 // Total bytes other side can send to client
+	Probe  bool   // Sender is blocked, other side reply with current limit
 }
-func (data *ClientData) Reader(r io.Reader) (err error) {
-	if err = data.Client.Reader(r); err != nil {
+
+func (update WindowUpdate) MarshalAppend(b []byte) (_ []byte, err error) {
+	var probe uint8
+	if update.Probe {
+		probe = 1
+	}
+	if b, err = update.Client.MarshalAppend(b); err != nil {
 		return
-	} else if data.Size, err = bigendian.ReadUint64(r); err != nil {
+	}
+	b = bigendian.AppendUint64(b, update.Limit)
+	return bigendian.AppendUint8(b, probe), nil
+}
+func (update *WindowUpdate) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, update.decode(&r))
+}
+func (update *WindowUpdate) decode(r *bigendian.Reader) (err error) {
+	if err = update.Client.decode(r); err != nil {
+		return
+	} else if update.Limit, err = r.Uint64(); err != nil {
 		return
 	}
+	probe, err := r.Uint8()
+	update.Probe = probe == 1
+	return err
+}
+
+// Acknowledge stream data recived
+type ClientAck struct {
+	Client Client // Client stream
+	Ack    uint64 // Next sequence expected, all before are recived
+}
 
-	data.Data = make([]byte, data.Size)
-	if _, err = r.Read(data.Data); err != nil {
+func (ack ClientAck) MarshalAppend(b []byte) (_ []byte, err error) {
+	if b, err = ack.Client.MarshalAppend(b); err != nil {
+		return
+	}
+	return bigendian.AppendUint64(b, ack.Ack), nil
+}
+func (ack *ClientAck) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, ack.decode(&r))
+}
+func (ack *ClientAck) decode(r *bigendian.Reader) (err error) {
+	if err = ack.Client.decode(r); err != nil {
 		return
 	}
+	ack.Ack, err = r.Uint64()
 	return
 }
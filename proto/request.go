@@ -10,10 +10,16 @@ import (
 )
 
 const (
-	ReqAuth        uint64 = 1 // Request Agent Auth
-	ReqPing        uint64 = 2 // Time ping
-	ReqCloseClient uint64 = 3 // Close client
-	ReqClientData  uint64 = 4 // Send data
+	ReqAuth          uint64 = 1  // Request Agent Auth
+	ReqPing          uint64 = 2  // Time ping
+	ReqCloseClient   uint64 = 3  // Close client
+	ReqClientData    uint64 = 4  // Send data
+	ReqClientAck     uint64 = 5  // Acknowledge data recived
+	ReqAgentShutdown uint64 = 6  // Agent shutdown graced
+	ReqResume        uint64 = 7  // Agent auth and resume tunnel session
+	ReqWindowUpdate  uint64 = 8  // Agent stream window update
+	ReqPathMTU       uint64 = 9  // Agent path MTU probe or size discovered
+	ReqHello         uint64 = 10 // Agent version and capabilities before auth
 )
 
 var (
@@ -22,100 +28,171 @@ var (
 
 type AgentAuth [36]byte
 
-func (agent AgentAuth) Writer(w io.Writer) error {
-	if err := bigendian.WriteBytes(w, agent[:]); err != nil {
-		return err
-	}
-	return nil
+func (agent AgentAuth) MarshalAppend(b []byte) ([]byte, error) {
+	return append(b, agent[:]...), nil
+}
+func (agent *AgentAuth) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, agent.decode(&r))
+}
+func (agent *AgentAuth) decode(r *bigendian.Reader) error {
+	return r.ReadFull(agent[:])
+}
+
+// Controller tunnel session
+type SessionID [16]byte
+
+// Authenticate agent and resume session after reconnect
+type AgentResume struct {
+	Token   AgentAuth // Agent token
+	Session SessionID // Session from last AgentInfo
+}
+
+func (resume AgentResume) MarshalAppend(b []byte) ([]byte, error) {
+	b = append(b, resume.Token[:]...)
+	return append(b, resume.Session[:]...), nil
+}
+func (resume *AgentResume) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, resume.decode(&r))
 }
-func (agent *AgentAuth) Reader(r io.Reader) error {
-	if err := bigendian.ReaderBytes(r, agent[:], 36); err != nil {
+func (resume *AgentResume) decode(r *bigendian.Reader) error {
+	if err := resume.Token.decode(r); err != nil {
 		return err
 	}
-	return nil
+	return r.ReadFull(resume.Session[:])
+}
+
+// Agent shutdown reason
+type AgentShutdown struct {
+	Reason string // Reason to controller register
+}
+
+func (shutdown AgentShutdown) MarshalAppend(b []byte) ([]byte, error) {
+	return appendString16(b, shutdown.Reason), nil
+}
+func (shutdown *AgentShutdown) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, shutdown.decode(&r))
+}
+func (shutdown *AgentShutdown) decode(r *bigendian.Reader) (err error) {
+	shutdown.Reason, err = readString16(r)
+	return
 }
 
 // Send request to agent and wait response
 type Request struct {
-	AgentAuth   *AgentAuth  `json:",omitempty"` // Send agent authentication to controller
-	Ping        *time.Time  `json:",omitempty"` // Send ping time to controller in unix milliseconds
-	ClientClose *Client     `json:",omitempty"` // Close client in controller
-	DataTX      *ClientData `json:",omitempty"` // Recive data from agent
+	ID uint32 `json:",omitempty"` // Request ID copied to response, zero if agent not wait response
+
+	AgentAuth   *AgentAuth   `json:",omitempty"` // Send agent authentication to controller
+	Ping        *time.Time   `json:",omitempty"` // Send ping time to controller in unix milliseconds
+	ClientClose *ClientClose `json:",omitempty"` // Close client in controller
+	DataTX      *ClientData  `json:",omitempty"` // Recive data from agent
+	DataAck     *ClientAck   `json:",omitempty"` // Agent acknowledge data from controller
+
+	AgentShutdown *AgentShutdown `json:",omitempty"` // Agent closing, controller stop tunnel
+	Resume        *AgentResume   `json:",omitempty"` // Agent reconnected, resume tunnel session
+	WindowUpdate  *WindowUpdate  `json:",omitempty"` // Agent consumed data from controller, controller can send more
+	PathMTU       *PathMTU       `json:",omitempty"` // Agent probe path MTU or set datagram size to controller
+	Hello         *Hello         `json:",omitempty"` // Agent version and capabilities, sent before auth
 }
 
+// Read one Request frame
 func ReaderRequest(r io.Reader) (*Request, error) {
 	res := &Request{}
-	if err := res.Reader(r); err != nil {
+	if err := readFrameBody(r, FrameRequest, res); err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
+// Write Request in frame
 func WriteRequest(w io.Writer, res Request) error {
-	buff, err := res.Wbytes()
-	if err != nil {
-		return err
-	} else if _, err := w.Write(buff); err != nil {
-		return err
-	}
-	return nil
+	return writeFrameBody(w, FrameRequest, res)
 }
 
 // Get Bytes from Request
 func (req Request) Wbytes() ([]byte, error) {
-	buff := new(bytes.Buffer)
-	if err := req.Writer(buff); err != nil {
-		return nil, err
+	return req.MarshalAppend(nil)
+}
+
+// Copy data from frame buffer, buffer is reused to next frame
+func (req *Request) detach() {
+	if req.DataTX != nil {
+		req.DataTX.Data = bytes.Clone(req.DataTX.Data)
 	}
-	return buff.Bytes(), nil
 }
 
-func (req Request) Writer(w io.Writer) error {
+func (req Request) MarshalAppend(b []byte) ([]byte, error) {
 	if auth := req.AgentAuth; auth != nil {
-		if err := bigendian.WriteUint64(w, ReqAuth); err != nil {
-			return err
-		}
-		return auth.Writer(w)
+		return auth.MarshalAppend(appendType(b, ReqAuth, req.ID))
 	} else if ping := req.Ping; ping != nil {
-		if err := bigendian.WriteUint64(w, ReqPing); err != nil {
-			return err
-		}
-		return bigendian.WriteInt64(w, ping.UnixMilli())
+		return bigendian.AppendInt64(appendType(b, ReqPing, req.ID), ping.UnixMilli()), nil
 	} else if close := req.ClientClose; close != nil {
-		if err := bigendian.WriteUint64(w, ReqCloseClient); err != nil {
-			return err
-		}
-		return close.Writer(w)
+		return close.MarshalAppend(appendType(b, ReqCloseClient, req.ID))
 	} else if data := req.DataTX; data != nil {
-		if err := bigendian.WriteUint64(w, ReqClientData); err != nil {
-			return err
-		}
-		return data.Writer(w)
+		return data.MarshalAppend(appendType(b, ReqClientData, req.ID))
+	} else if ack := req.DataAck; ack != nil {
+		return ack.MarshalAppend(appendType(b, ReqClientAck, req.ID))
+	} else if shutdown := req.AgentShutdown; shutdown != nil {
+		return shutdown.MarshalAppend(appendType(b, ReqAgentShutdown, req.ID))
+	} else if resume := req.Resume; resume != nil {
+		return resume.MarshalAppend(appendType(b, ReqResume, req.ID))
+	} else if update := req.WindowUpdate; update != nil {
+		return update.MarshalAppend(appendType(b, ReqWindowUpdate, req.ID))
+	} else if mtu := req.PathMTU; mtu != nil {
+		return mtu.MarshalAppend(appendType(b, ReqPathMTU, req.ID))
+	} else if hello := req.Hello; hello != nil {
+		return hello.MarshalAppend(appendType(b, ReqHello, req.ID))
 	}
-	return ErrInvalidBody
+	return b, ErrInvalidBody
+}
+
+// Decode request, DataTX.Data is slice of b and must be copied before reuse b
+func (req *Request) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, req.decode(&r))
 }
-func (req *Request) Reader(r io.Reader) (err error) {
+func (req *Request) decode(r *bigendian.Reader) (err error) {
 	var reqID uint64
-	if reqID, err = bigendian.ReadUint64(r); err != nil {
+	if reqID, req.ID, err = readType(r); err != nil {
 		return
 	}
 	if reqID == ReqAuth {
 		req.AgentAuth = new(AgentAuth)
-		return req.AgentAuth.Reader(r)
+		return req.AgentAuth.decode(r)
 	} else if reqID == ReqPing {
 		var timeUnix int64
-		if timeUnix, err = bigendian.ReadInt64(r); err != nil {
+		if timeUnix, err = r.Int64(); err != nil {
 			return
 		}
 		req.Ping = new(time.Time)
 		*req.Ping = time.UnixMilli(timeUnix)
 		return
 	} else if reqID == ReqCloseClient {
-		req.ClientClose = new(Client)
-		return req.ClientClose.Reader(r)
+		req.ClientClose = new(ClientClose)
+		return req.ClientClose.decode(r)
 	} else if reqID == ReqClientData {
 		req.DataTX = new(ClientData)
-		return req.DataTX.Reader(r)
+		return req.DataTX.decode(r)
+	} else if reqID == ReqClientAck {
+		req.DataAck = new(ClientAck)
+		return req.DataAck.decode(r)
+	} else if reqID == ReqAgentShutdown {
+		req.AgentShutdown = new(AgentShutdown)
+		return req.AgentShutdown.decode(r)
+	} else if reqID == ReqResume {
+		req.Resume = new(AgentResume)
+		return req.Resume.decode(r)
+	} else if reqID == ReqWindowUpdate {
+		req.WindowUpdate = new(WindowUpdate)
+		return req.WindowUpdate.decode(r)
+	} else if reqID == ReqPathMTU {
+		req.PathMTU = new(PathMTU)
+		return req.PathMTU.decode(r)
+	} else if reqID == ReqHello {
+		req.Hello = new(Hello)
+		return req.Hello.decode(r)
 	}
 	return ErrInvalidBody
 }
@@ -0,0 +1,123 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/buffer"
+)
+
+var testClient = Client{Client: netip.MustParseAddrPort("[2001:db8::1]:25565"), Proto: ProtoTCP, Mapping: 3}
+
+// Request or response with pointers as JSON to test errors
+func dump(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func testRequests() []Request {
+	ping := time.UnixMilli(1700000000000)
+	auth := AgentAuth{1, 2, 3}
+	return []Request{
+		{AgentAuth: &auth},
+		{ID: 7, Ping: &ping},
+		{ClientClose: &ClientClose{Client: testClient}},
+		{ClientClose: &ClientClose{Client: testClient, Kind: CloseAbort, Reason: "connection refused"}},
+		{DataTX: &ClientData{Client: testClient, Seq: 9, Fragment: Fragment{ID: 1, Index: 1, Count: 2}, Size: 4, Data: []byte("data")}},
+		{DataAck: &ClientAck{Client: testClient, Ack: 10}},
+		{ID: 8, AgentShutdown: &AgentShutdown{Reason: "update"}},
+		{ID: 9, Resume: &AgentResume{Token: auth, Session: SessionID{4}}},
+		{WindowUpdate: &WindowUpdate{Client: testClient, Limit: InitialWindow, Probe: true}},
+		{PathMTU: &PathMTU{Size: MinDatagramSize, Probe: true}},
+		{Hello: &Hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Capabilities: CapMappings, Software: "devel", OS: "linux", Arch: "amd64"}},
+	}
+}
+
+func FuzzRequest(f *testing.F) {
+	for _, req := range testRequests() {
+		data, err := req.MarshalAppend(nil)
+		if err != nil {
+			f.Fatalf("marshal %s: %s", dump(req), err)
+		}
+		var decoded Request
+		if err := decoded.Unmarshal(data); err != nil {
+			f.Fatalf("unmarshal %s: %s", dump(req), err)
+		} else if !reflect.DeepEqual(req, decoded) {
+			f.Fatalf("request %s decoded as %s", dump(req), dump(decoded))
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var req Request
+		if req.Unmarshal(data) != nil {
+			return
+		}
+		encoded, err := req.MarshalAppend(nil)
+		if err != nil {
+			t.Fatalf("marshal decoded request %s: %s", dump(req), err)
+		}
+		var again Request
+		if err := again.Unmarshal(encoded); err != nil {
+			t.Fatalf("unmarshal encoded request %s: %s", dump(req), err)
+		} else if !reflect.DeepEqual(req, again) {
+			t.Fatalf("request %s encoded and decoded as %s", dump(req), dump(again))
+		}
+	})
+}
+
+// Minecraft packet in one client datagram
+var benchData = bytes.Repeat([]byte{0x2a}, 1400)
+
+func BenchmarkRequestMarshalAppend(b *testing.B) {
+	req := Request{DataTX: &ClientData{Client: testClient, Seq: 9, Size: uint64(len(benchData)), Data: benchData}}
+	buff := make([]byte, 0, buffer.Size)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buff, err = req.MarshalAppend(buff[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRequestUnmarshal(b *testing.B) {
+	data, err := Request{DataTX: &ClientData{Client: testClient, Seq: 9, Size: uint64(len(benchData)), Data: benchData}}.MarshalAppend(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		var req Request
+		if err := req.Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Size outside datagram range not underflow padding
+func TestPathMTUSize(t *testing.T) {
+	for _, size := range []uint16{0, DataOverhead - 1, MinDatagramSize - 1, MaxDatagramSize + 1} {
+		for _, probe := range []bool{false, true} {
+			if _, err := (PathMTU{Size: size, Probe: probe}).MarshalAppend(nil); err != ErrInvalidBody {
+				t.Errorf("marshal size %d probe %v return %v", size, probe, err)
+			}
+		}
+	}
+
+	data, err := PathMTU{Size: MinDatagramSize, Probe: true}.MarshalAppend(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != int(MinDatagramSize-DataOverhead)+3 {
+		t.Fatalf("probe with %d bytes", len(data))
+	}
+	var mtu PathMTU
+	if err = mtu.Unmarshal(data); err != nil || mtu != (PathMTU{Size: MinDatagramSize, Probe: true}) {
+		t.Fatalf("unmarshal %+v, %v", mtu, err)
+	}
+}
@@ -2,6 +2,7 @@ package proto
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"net/netip"
 	"time"
@@ -10,189 +11,381 @@ import (
 )
 
 const (
-	ResUnauthorized uint64 = 1 // Request not processed and ignored
-	ResBadRequest   uint64 = 2 // Request cannot process and ignored
-	ResCloseClient  uint64 = 3 // Controller closed connection
-	ResClientData   uint64 = 4 // Controller accepted data
-	ResSendAuth     uint64 = 5 // Send token to controller
-	ResAgentInfo    uint64 = 6 // Agent info
-	ResPong         uint64 = 7 // Ping response
-	ResNotListening uint64 = 8 // Resize buffer size
+	ResUnauthorized  uint64 = 1  // Agent token rejected, Error to peers before VersionError
+	ResBadRequest    uint64 = 2  // Request cannot process, Error to peers before VersionError
+	ResCloseClient   uint64 = 3  // Controller closed connection
+	ResClientData    uint64 = 4  // Controller accepted data
+	ResSendAuth      uint64 = 5  // Send token to controller
+	ResAgentInfo     uint64 = 6  // Agent info
+	ResPong          uint64 = 7  // Ping response
+	ResNotListening  uint64 = 8  // Controller cannot listen mapping, Error to peers before VersionError
+	ResClientAck     uint64 = 9  // Controller acknowledge data recived
+	ResAgentShutdown uint64 = 10 // Controller accepted agent shutdown
+	ResWindowUpdate  uint64 = 11 // Controller stream window update
+	ResPathMTU       uint64 = 12 // Controller echo path MTU probe
+	ResHello         uint64 = 13 // Controller version and capabilities negotiated
+	ResIncompatible  uint64 = 14 // Controller not support agent protocol version
+	ResError         uint64 = 15 // Controller cannot process request or tunnel, replace Unauthorized, BadRequest and NotListening from VersionError
+	ResNewClient     uint64 = 16 // Controller accepted client, agent dial target before data
 )
 
-type AgentInfo struct {
-	Protocol         uint8          // Proto supported (proto.ProtoTCP, proto.ProtoUDP or proto.ProtoBoth)
-	UDPPort, TCPPort uint16         // Controller port listened
-	AddrPort         netip.AddrPort // request address and port
+// Error codes in Error response
+const (
+	CodeUnknown      uint16 = iota // Error without code
+	CodeUnauthorized               // Agent token rejected, agent must stop
+	CodeBadRequest                 // Request invalid or cannot be processed
+	CodePortInUse                  // Mapping port used by other process
+	CodePortQuota                  // No free port in pool to mapping
+	CodePortDisabled               // Mapping port disabled or controller not permitted to listen
+	CodeListen                     // Mapping cannot listen by other reason
+	CodeInternal                   // Controller failed to process request, agent can retry
+)
+
+var codeNames = map[uint16]string{
+	CodeUnknown:      "unknown",
+	CodeUnauthorized: "unauthorized",
+	CodeBadRequest:   "bad request",
+	CodePortInUse:    "port in use",
+	CodePortQuota:    "port quota exceeded",
+	CodePortDisabled: "port disabled",
+	CodeListen:       "cannot listen",
+	CodeInternal:     "internal error",
 }
 
-func (agent AgentInfo) Writer(w io.Writer) error {
-	if err := bigendian.WriteUint8(w, agent.Protocol); err != nil {
-		return err
-	} else if err := bigendian.WriteUint16(w, agent.UDPPort); err != nil {
-		return err
-	} else if err := bigendian.WriteUint16(w, agent.TCPPort); err != nil {
-		return err
+// Error code name
+func CodeName(code uint16) string {
+	if name, ok := codeNames[code]; ok {
+		return name
 	}
-	addr := agent.AddrPort.Addr()
-	if addr.Is4() {
-		if err := bigendian.WriteUint8(w, 4); err != nil {
-			return err
-		} else if err := bigendian.WriteBytes(w, addr.As4()); err != nil {
-			return err
-		}
-	} else {
-		if err := bigendian.WriteUint8(w, 6); err != nil {
-			return err
-		} else if err := bigendian.WriteBytes(w, addr.As16()); err != nil {
-			return err
-		}
+	return fmt.Sprintf("code %d", code)
+}
+
+// Controller error with code and reason
+type Error struct {
+	Code      uint16  // Error code
+	Message   string  // Reason to show to user
+	Client    *Client `json:",omitempty"` // Client related to error
+	RequestID uint32  `json:",omitempty"` // Request related to error, zero if not related to request
+
+	legacy bool // Encode as response type without code and message, set by For
+}
+
+func (err *Error) Error() string {
+	if err.Message == "" {
+		return CodeName(err.Code)
 	}
-	if err := bigendian.WriteUint16(w, agent.AddrPort.Port()); err != nil {
-		return err
+	return CodeName(err.Code) + ": " + err.Message
+}
+
+// Errors with same code are equal to errors.Is
+func (err *Error) Is(target error) bool {
+	other, ok := target.(*Error)
+	return ok && other.Code == err.Code
+}
+
+// Mapping cannot listen, tunnel is not created
+func (err *Error) IsListen() bool {
+	return err.Code >= CodePortInUse && err.Code <= CodeListen
+}
+
+// Error in layout peer with negotiated version can decode, peers before VersionError get only response type from code
+func (resErr Error) For(version uint16) *Error {
+	resErr.legacy = version < VersionError
+	return &resErr
+}
+
+// Response type to peers before VersionError
+func (resErr *Error) legacyType() uint64 {
+	if resErr.Code == CodeUnauthorized {
+		return ResUnauthorized
+	} else if resErr.IsListen() {
+		return ResNotListening
 	}
-	return nil
+	return ResBadRequest
+}
+
+func (resErr Error) MarshalAppend(b []byte) ([]byte, error) {
+	b = bigendian.AppendUint16(b, resErr.Code)
+	b = appendString16(b, resErr.Message)
+	b = bigendian.AppendUint32(b, resErr.RequestID)
+	if resErr.Client == nil {
+		return bigendian.AppendUint8(b, 0), nil
+	}
+	return resErr.Client.MarshalAppend(bigendian.AppendUint8(b, 1))
+}
+func (resErr *Error) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, resErr.decode(&r))
 }
-func (agent *AgentInfo) Reader(r io.Reader) (err error) {
-	if agent.Protocol, err = bigendian.ReadUint8(r); err != nil {
+func (resErr *Error) decode(r *bigendian.Reader) (err error) {
+	var hasClient uint8
+	if resErr.Code, err = r.Uint16(); err != nil {
 		return
-	} else if agent.UDPPort, err = bigendian.ReadUint16(r); err != nil {
+	} else if resErr.Message, err = readString16(r); err != nil {
 		return
-	} else if agent.TCPPort, err = bigendian.ReadUint16(r); err != nil {
+	} else if resErr.RequestID, err = r.Uint32(); err != nil {
 		return
+	} else if hasClient, err = r.Uint8(); err != nil {
+		return
+	}
+	if hasClient == 1 {
+		resErr.Client = new(Client)
+		return resErr.Client.decode(r)
+	}
+	return
+}
+
+// Agent protocol version not supported by controller
+type Incompatible struct {
+	Version    uint16 // Controller max version
+	MinVersion uint16 // Controller oldest version
+	Message    string // Reason to show to user
+}
+
+func (incompatible Incompatible) MarshalAppend(b []byte) ([]byte, error) {
+	b = bigendian.AppendUint16(b, incompatible.Version)
+	b = bigendian.AppendUint16(b, incompatible.MinVersion)
+	return appendString8(b, incompatible.Message), nil
+}
+func (incompatible *Incompatible) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, incompatible.decode(&r))
+}
+func (incompatible *Incompatible) decode(r *bigendian.Reader) (err error) {
+	if incompatible.Version, err = r.Uint16(); err != nil {
+		return
+	} else if incompatible.MinVersion, err = r.Uint16(); err != nil {
+		return
+	}
+	incompatible.Message, err = readString8(r)
+	return
+}
+
+type AgentInfo struct {
+	AddrPort  netip.AddrPort // request address and port
+	SessionID SessionID      // Session to resume tunnel after reconnect
+	Mappings  []Mapping      // Ports listened to agent
+}
+
+// Find mapping by ID
+func (agent AgentInfo) Mapping(ID uint16) (Mapping, bool) {
+	for _, mapping := range agent.Mappings {
+		if mapping.ID == ID {
+			return mapping, true
+		}
 	}
+	return Mapping{}, false
+}
+
+func (agent AgentInfo) MarshalAppend(b []byte) (_ []byte, err error) {
+	addr := agent.AddrPort.Addr()
+	if addr.Is4() {
+		ip := addr.As4()
+		b = append(bigendian.AppendUint8(b, 4), ip[:]...)
+	} else {
+		ip := addr.As16()
+		b = append(bigendian.AppendUint8(b, 6), ip[:]...)
+	}
+	b = bigendian.AppendUint16(b, agent.AddrPort.Port())
+	b = append(b, agent.SessionID[:]...)
+	b = bigendian.AppendUint16(b, uint16(len(agent.Mappings)))
+	for _, mapping := range agent.Mappings {
+		if b, err = mapping.MarshalAppend(b); err != nil {
+			return
+		}
+	}
+	return b, nil
+}
+func (agent *AgentInfo) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, agent.decode(&r))
+}
+func (agent *AgentInfo) decode(r *bigendian.Reader) (err error) {
 	var addrFamily uint8
 	var addrPort uint16
 	var ipBytes []byte
-	if addrFamily, err = bigendian.ReadUint8(r); err != nil {
+	if addrFamily, err = r.Uint8(); err != nil {
 		return
 	} else if addrFamily == 4 {
-		if ipBytes, err = bigendian.ReadBytesN(r, 4); err != nil {
+		if ipBytes, err = r.Bytes(4); err != nil {
 			return
 		}
 	} else if addrFamily == 6 {
-		if ipBytes, err = bigendian.ReadBytesN(r, 16); err != nil {
+		if ipBytes, err = r.Bytes(16); err != nil {
 			return
 		}
+	} else {
+		return ErrInvalidBody
 	}
-	if addrPort, err = bigendian.ReadUint16(r); err != nil {
+	if addrPort, err = r.Uint16(); err != nil {
 		return
 	} else if len(ipBytes) == 16 {
 		agent.AddrPort = netip.AddrPortFrom(netip.AddrFrom16([16]byte(ipBytes)), addrPort)
-	} else {
+	} else if len(ipBytes) == 4 {
 		agent.AddrPort = netip.AddrPortFrom(netip.AddrFrom4([4]byte(ipBytes)), addrPort)
 	}
+	if err = r.ReadFull(agent.SessionID[:]); err != nil {
+		return
+	}
+	size, err := r.Uint16()
+	if err != nil {
+		return err
+	}
+	agent.Mappings = make([]Mapping, size)
+	for index := range agent.Mappings {
+		if err = agent.Mappings[index].decode(r); err != nil {
+			return
+		}
+	}
 	return
 }
 
 // Reader data from Controller and process in agent
 type Response struct {
-	Unauthorized bool `json:",omitempty"` // Controller reject connection
-	BadRequest   bool `json:",omitempty"` // Controller accepted packet so cannot process Request
-	SendAuth     bool `json:",omitempty"` // Send Agent token
-	NotListened  bool `json:",omitempty"` // Controller cannot Listen port
+	ID uint32 `json:",omitempty"` // Request ID answered, zero if response is not reply to request
+
+	SendAuth    bool `json:",omitempty"` // Send Agent token
+	ShutdownAck bool `json:",omitempty"` // Controller accepted agent shutdown and closed tunnel
 
 	AgentInfo *AgentInfo `json:",omitempty"` // Agent Info
 	Pong      *time.Time `json:",omitempty"` // ping response
 
-	CloseClient *Client     `json:",omitempty"` // Controller end client
-	DataRX      *ClientData `json:",omitempty"` // Controller recive data from client
+	NewClient   *Client      `json:",omitempty"` // Controller accepted client
+	CloseClient *ClientClose `json:",omitempty"` // Controller end client
+	DataRX      *ClientData  `json:",omitempty"` // Controller recive data from client
+	DataAck     *ClientAck   `json:",omitempty"` // Controller acknowledge data from agent
+
+	WindowUpdate *WindowUpdate `json:",omitempty"` // Controller consumed data from agent, agent can send more
+	PathMTU      *PathMTU      `json:",omitempty"` // Controller echo agent probe
+	Hello        *Hello        `json:",omitempty"` // Controller version and capabilities negotiated
+	Incompatible *Incompatible `json:",omitempty"` // Agent version rejected
+	Error        *Error        `json:",omitempty"` // Controller cannot process request or tunnel
 }
 
+// Read one Response frame
 func ReaderResponse(r io.Reader) (*Response, error) {
 	res := &Response{}
-	if err := res.Reader(r); err != nil {
+	if err := readFrameBody(r, FrameResponse, res); err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
+// Write Response in frame
 func WriteResponse(w io.Writer, res Response) error {
-	buff, err := res.Wbytes()
-	if err != nil {
-		return err
-	} else if _, err := w.Write(buff); err != nil {
-		return err
-	}
-	return nil
+	return writeFrameBody(w, FrameResponse, res)
 }
 
 // Get Bytes from Response
-func (req Response) Wbytes() ([]byte, error) {
-	buff := new(bytes.Buffer)
-	if err := req.Writer(buff); err != nil {
-		return nil, err
+func (res Response) Wbytes() ([]byte, error) {
+	return res.MarshalAppend(nil)
+}
+
+// Copy data from frame buffer, buffer is reused to next frame
+func (res *Response) detach() {
+	if res.DataRX != nil {
+		res.DataRX.Data = bytes.Clone(res.DataRX.Data)
 	}
-	return buff.Bytes(), nil
 }
 
-func (res Response) Writer(w io.Writer) error {
-	if res.Unauthorized {
-		return bigendian.WriteUint64(w, ResUnauthorized)
-	} else if res.BadRequest {
-		return bigendian.WriteUint64(w, ResBadRequest)
-	} else if res.SendAuth {
-		return bigendian.WriteUint64(w, ResSendAuth)
-	} else if res.NotListened {
-		return bigendian.WriteUint64(w, ResNotListening)
+func (res Response) MarshalAppend(b []byte) ([]byte, error) {
+	if res.SendAuth {
+		return appendType(b, ResSendAuth, res.ID), nil
+	} else if res.ShutdownAck {
+		return appendType(b, ResAgentShutdown, res.ID), nil
 	} else if pong := res.Pong; pong != nil {
-		if err := bigendian.WriteUint64(w, ResPong); err != nil {
-			return err
-		}
-		return bigendian.WriteInt64(w, pong.UnixMilli())
+		return bigendian.AppendInt64(appendType(b, ResPong, res.ID), pong.UnixMilli()), nil
+	} else if newClient := res.NewClient; newClient != nil {
+		return newClient.MarshalAppend(appendType(b, ResNewClient, res.ID))
 	} else if closeClient := res.CloseClient; closeClient != nil {
-		if err := bigendian.WriteUint64(w, ResCloseClient); err != nil {
-			return err
-		}
-		return closeClient.Writer(w)
+		return closeClient.MarshalAppend(appendType(b, ResCloseClient, res.ID))
 	} else if rx := res.DataRX; rx != nil {
-		if err := bigendian.WriteUint64(w, ResClientData); err != nil {
-			return err
-		}
-		return rx.Writer(w)
+		return rx.MarshalAppend(appendType(b, ResClientData, res.ID))
 	} else if info := res.AgentInfo; info != nil {
-		if err := bigendian.WriteUint64(w, ResAgentInfo); err != nil {
-			return err
+		return info.MarshalAppend(appendType(b, ResAgentInfo, res.ID))
+	} else if ack := res.DataAck; ack != nil {
+		return ack.MarshalAppend(appendType(b, ResClientAck, res.ID))
+	} else if update := res.WindowUpdate; update != nil {
+		return update.MarshalAppend(appendType(b, ResWindowUpdate, res.ID))
+	} else if mtu := res.PathMTU; mtu != nil {
+		return mtu.MarshalAppend(appendType(b, ResPathMTU, res.ID))
+	} else if hello := res.Hello; hello != nil {
+		return hello.MarshalAppend(appendType(b, ResHello, res.ID))
+	} else if incompatible := res.Incompatible; incompatible != nil {
+		return incompatible.MarshalAppend(appendType(b, ResIncompatible, res.ID))
+	} else if resErr := res.Error; resErr != nil {
+		if resErr.legacy {
+			return appendType(b, resErr.legacyType(), res.ID), nil
 		}
-		return info.Writer(w)
+		return resErr.MarshalAppend(appendType(b, ResError, res.ID))
 	}
-	return ErrInvalidBody
+	return b, ErrInvalidBody
 }
-func (res *Response) Reader(r io.Reader) error {
-	resID, err := bigendian.ReadUint64(r)
-	if err != nil {
-		return err
+
+// Decode response, DataRX.Data is slice of b and must be copied before reuse b
+func (res *Response) Unmarshal(b []byte) error {
+	r := bigendian.NewReader(b)
+	return decoded(&r, res.decode(&r))
+}
+func (res *Response) decode(r *bigendian.Reader) (err error) {
+	var resID uint64
+	if resID, res.ID, err = readType(r); err != nil {
+		return
 	}
 
-	if resID == ResBadRequest {
-		res.BadRequest = true
-		return nil
-	} else if resID == ResUnauthorized {
-		res.Unauthorized = true
-		return nil
-	} else if resID == ResNotListening {
-		res.NotListened = true
-		return nil
-	} else if resID == ResSendAuth {
+	if resID == ResSendAuth {
 		res.SendAuth = true
 		return nil
+	} else if resID == ResAgentShutdown {
+		res.ShutdownAck = true
+		return nil
+	} else if resID == ResNewClient {
+		res.NewClient = new(Client)
+		return res.NewClient.decode(r)
 	} else if resID == ResCloseClient {
-		res.CloseClient = new(Client)
-		return res.CloseClient.Reader(r)
+		res.CloseClient = new(ClientClose)
+		return res.CloseClient.decode(r)
 	} else if resID == ResClientData {
 		res.DataRX = new(ClientData)
-		return res.DataRX.Reader(r)
+		return res.DataRX.decode(r)
 	} else if resID == ResAgentInfo {
 		res.AgentInfo = new(AgentInfo)
-		return res.AgentInfo.Reader(r)
+		return res.AgentInfo.decode(r)
 	} else if resID == ResPong {
-		unixMil, err := bigendian.ReadInt64(r)
+		unixMil, err := r.Int64()
 		if err != nil {
 			return err
 		}
 		res.Pong = new(time.Time)
 		*res.Pong = time.UnixMilli(unixMil)
 		return nil
+	} else if resID == ResClientAck {
+		res.DataAck = new(ClientAck)
+		return res.DataAck.decode(r)
+	} else if resID == ResWindowUpdate {
+		res.WindowUpdate = new(WindowUpdate)
+		return res.WindowUpdate.decode(r)
+	} else if resID == ResPathMTU {
+		res.PathMTU = new(PathMTU)
+		return res.PathMTU.decode(r)
+	} else if resID == ResHello {
+		res.Hello = new(Hello)
+		return res.Hello.decode(r)
+	} else if resID == ResIncompatible {
+		res.Incompatible = new(Incompatible)
+		return res.Incompatible.decode(r)
+	} else if resID == ResError {
+		res.Error = new(Error)
+		return res.Error.decode(r)
+	} else if resID == ResUnauthorized {
+		res.Error = &Error{Code: CodeUnauthorized} // Controller before VersionError
+		return nil
+	} else if resID == ResBadRequest {
+		res.Error = &Error{Code: CodeBadRequest}
+		return nil
+	} else if resID == ResNotListening {
+		res.Error = &Error{Code: CodeListen}
+		return nil
 	}
 	return ErrInvalidBody
 }
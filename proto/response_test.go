@@ -0,0 +1,127 @@
+package proto
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/bigendian"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/buffer"
+)
+
+func testResponses() []Response {
+	pong := time.UnixMilli(1700000000000)
+	return []Response{
+		{SendAuth: true},
+		{ID: 1, ShutdownAck: true},
+		{ID: 2, Pong: &pong},
+		{NewClient: &testClient},
+		{CloseClient: &ClientClose{Client: testClient, Kind: CloseWrite}},
+		{DataRX: &ClientData{Client: testClient, Size: 4, Data: []byte("data")}},
+		{ID: 3, AgentInfo: &AgentInfo{AddrPort: netip.MustParseAddrPort("192.0.2.1:4000"), SessionID: SessionID{1}, Mappings: []Mapping{{ID: 1, Name: "game", Proto: ProtoBoth, Port: 25565}}}},
+		{DataAck: &ClientAck{Client: testClient, Ack: 5}},
+		{WindowUpdate: &WindowUpdate{Client: testClient, Limit: 1 << 20}},
+		{PathMTU: &PathMTU{Size: MaxDatagramSize}},
+		{Hello: &Hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Capabilities: CapNewClient}},
+		{Incompatible: &Incompatible{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Message: "update agent"}},
+		{ID: 4, Error: &Error{Code: CodeUnauthorized, Message: "invalid token", Client: &testClient, RequestID: 4}},
+	}
+}
+
+func FuzzResponse(f *testing.F) {
+	for _, res := range testResponses() {
+		data, err := res.MarshalAppend(nil)
+		if err != nil {
+			f.Fatalf("marshal %s: %s", dump(res), err)
+		}
+		var decoded Response
+		if err := decoded.Unmarshal(data); err != nil {
+			f.Fatalf("unmarshal %s: %s", dump(res), err)
+		} else if !reflect.DeepEqual(res, decoded) {
+			f.Fatalf("response %s decoded as %s", dump(res), dump(decoded))
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var res Response
+		if res.Unmarshal(data) != nil {
+			return
+		}
+		encoded, err := res.MarshalAppend(nil)
+		if err != nil {
+			t.Fatalf("marshal decoded response %s: %s", dump(res), err)
+		}
+		var again Response
+		if err := again.Unmarshal(encoded); err != nil {
+			t.Fatalf("unmarshal encoded response %s: %s", dump(res), err)
+		} else if !reflect.DeepEqual(res, again) {
+			t.Fatalf("response %s encoded and decoded as %s", dump(res), dump(again))
+		}
+	})
+}
+
+// Peers before VersionError decode only response type, code is kept by type
+func TestErrorFor(t *testing.T) {
+	tests := []struct {
+		err     Error
+		resType uint64
+		code    uint16
+	}{
+		{Error{Code: CodeUnauthorized, Message: "invalid token"}, ResUnauthorized, CodeUnauthorized},
+		{Error{Code: CodePortInUse, Message: "port 25565", Client: &testClient}, ResNotListening, CodeListen},
+		{Error{Code: CodeInternal, RequestID: 2}, ResBadRequest, CodeBadRequest},
+	}
+	for _, test := range tests {
+		data, err := Response{Error: test.err.For(MinProtocolVersion)}.MarshalAppend(nil)
+		if err != nil {
+			t.Fatalf("marshal %s: %s", dump(test.err), err)
+		}
+		r := bigendian.NewReader(data)
+		if resType, _, err := readType(&r); err != nil || resType != test.resType || r.Len() != 0 {
+			t.Errorf("error %s sent as type %d with %d bytes body, expected type %d", dump(test.err), resType, r.Len(), test.resType)
+		}
+		var res Response
+		if err := res.Unmarshal(data); err != nil {
+			t.Fatalf("unmarshal %s: %s", dump(test.err), err)
+		} else if res.Error == nil || res.Error.Code != test.code {
+			t.Errorf("error %s decoded as %s", dump(test.err), dump(res))
+		}
+
+		if data, err = (Response{Error: test.err.For(VersionError)}).MarshalAppend(nil); err != nil {
+			t.Fatalf("marshal %s: %s", dump(test.err), err)
+		} else if err = res.Unmarshal(data); err != nil {
+			t.Fatalf("unmarshal %s: %s", dump(test.err), err)
+		} else if res.Error.Code != test.err.Code || res.Error.Message != test.err.Message || res.Error.RequestID != test.err.RequestID {
+			t.Errorf("error %s decoded as %s", dump(test.err), dump(res.Error))
+		}
+	}
+}
+
+func BenchmarkResponseMarshalAppend(b *testing.B) {
+	res := Response{DataRX: &ClientData{Client: testClient, Seq: 9, Size: uint64(len(benchData)), Data: benchData}}
+	buff := make([]byte, 0, buffer.Size)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buff, err = res.MarshalAppend(buff[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResponseUnmarshal(b *testing.B) {
+	data, err := Response{DataRX: &ClientData{Client: testClient, Seq: 9, Size: uint64(len(benchData)), Data: benchData}}.MarshalAppend(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		var res Response
+		if err := res.Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoPorts          error = errors.New("no free ports in pool")
+	ErrInvalidPortRange error = errors.New("invalid port range, use first-last")
+
+	PortReserveTTL time.Duration = time.Hour * 24 // Default time port is kept to owner after tunnel close
+)
+
+// Ports assigned to tunnel mappings, mapping keep same port across reconnects
+type PortPool struct {
+	First, Last uint16                          // Ports range
+	TTL         time.Duration                   // Port of closed tunnel is kept to owner in this time, zero keep forever
+	OnReserve   func(owner string, port uint16) // Called with pool lock when owner get new port, persist reservation
+	OnRelease   func(owner string)              // Called with pool lock when owner reservation expire
+
+	mu       sync.Mutex
+	reserved map[string]uint16    // Owner port
+	used     map[uint16]string    // Port owner
+	idle     map[string]time.Time // Owners not listening since time, released after TTL
+	pending  map[uint16]bool      // Ports being listened outside lock
+	next     uint16               // Offset in range to next free port search
+}
+
+// Create pool with ports between first and last
+func NewPortPool(first, last uint16) (*PortPool, error) {
+	if first == 0 || first > last {
+		return nil, ErrInvalidPortRange
+	}
+	return &PortPool{
+		First:    first,
+		Last:     last,
+		TTL:      PortReserveTTL,
+		reserved: make(map[string]uint16),
+		used:     make(map[uint16]string),
+		idle:     make(map[string]time.Time),
+		pending:  make(map[uint16]bool),
+	}, nil
+}
+
+// Parse "first-last" port range and create pool
+func ParsePortRange(value string) (*PortPool, error) {
+	first, last, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, ErrInvalidPortRange
+	}
+	firstPort, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil {
+		return nil, ErrInvalidPortRange
+	}
+	lastPort, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+	if err != nil {
+		return nil, ErrInvalidPortRange
+	}
+	return NewPortPool(uint16(firstPort), uint16(lastPort))
+}
+
+// Owner key to tunnel mapping
+func PortOwner(token [36]byte, mapping uint16) string {
+	return fmt.Sprintf("%x/%d", token, mapping)
+}
+
+// Restore reservation, return false if port is out of range or reserved to other owner.
+// Restored port is released after TTL if owner not listen
+func (pool *PortPool) Reserve(owner string, port uint16) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if port < pool.First || port > pool.Last {
+		return false
+	} else if current, ok := pool.used[port]; ok && current != owner {
+		return false
+	}
+	pool.set(owner, port)
+	pool.idle[owner] = time.Now()
+	return true
+}
+
+// Release owner port to other tunnels
+func (pool *PortPool) Release(owner string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.release(owner)
+}
+
+func (pool *PortPool) release(owner string) {
+	if port, ok := pool.reserved[owner]; ok {
+		delete(pool.used, port)
+		delete(pool.reserved, owner)
+	}
+	delete(pool.idle, owner)
+}
+
+// Owner stopped listen port, port is released to other tunnels after TTL if owner not listen again
+func (pool *PortPool) Detach(owner string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if _, ok := pool.reserved[owner]; ok {
+		pool.idle[owner] = time.Now()
+	}
+}
+
+// Release port if owner is idle more than TTL, caller must hold lock
+func (pool *PortPool) expired(port uint16) bool {
+	owner := pool.used[port]
+	since, idle := pool.idle[owner]
+	if !idle || pool.TTL <= 0 || time.Since(since) < pool.TTL {
+		return false
+	}
+	pool.release(owner)
+	if pool.OnRelease != nil {
+		pool.OnRelease(owner)
+	}
+	return true
+}
+
+// Port reserved to owner
+func (pool *PortPool) Port(owner string) (uint16, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	port, ok := pool.reserved[owner]
+	return port, ok
+}
+
+func (pool *PortPool) set(owner string, port uint16) {
+	if old, ok := pool.reserved[owner]; ok {
+		delete(pool.used, old)
+	}
+	pool.reserved[owner] = port
+	pool.used[port] = owner
+}
+
+// Next free port after offset in range and mark pending, return offset of port.
+// Search start after last port assigned, so mappings not scan ports already used
+func (pool *PortPool) claim(offset int) (uint16, int, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	size := int(pool.Last-pool.First) + 1
+	for ; offset < size; offset++ {
+		port := pool.First + uint16((int(pool.next)+offset)%size)
+		if _, used := pool.used[port]; used && !pool.expired(port) {
+			continue
+		} else if pool.pending[port] {
+			continue
+		}
+		pool.pending[port] = true
+		return port, offset, true
+	}
+	return 0, offset, false
+}
+
+// Reserve port listened to owner, or release pending port if listen failed
+func (pool *PortPool) commit(owner string, port uint16, listened bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	delete(pool.pending, port)
+	if !listened {
+		return
+	}
+	delete(pool.idle, owner)
+	if pool.used[port] == owner {
+		return // Same reservation
+	}
+	pool.set(owner, port)
+	pool.next = port - pool.First + 1
+	if pool.OnReserve != nil {
+		pool.OnReserve(owner, port)
+	}
+}
+
+// Listen owner reserved port, if not reserved or port is taken by other process
+// try free ports in range and reserve first port listened. listen is called without pool lock
+func (pool *PortPool) Listen(owner string, listen func(port uint16) error) (uint16, error) {
+	if port, ok := pool.Port(owner); ok && listen(port) == nil {
+		pool.commit(owner, port, true) // Reservation can expire while listen
+		return port, nil
+	}
+
+	for offset := 0; ; offset++ {
+		port, next, ok := pool.claim(offset)
+		if !ok {
+			return 0, ErrNoPorts
+		}
+		err := listen(port)
+		pool.commit(owner, port, err == nil)
+		if err == nil {
+			return port, nil
+		}
+		offset = next // Port used by other process
+	}
+}
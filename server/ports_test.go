@@ -0,0 +1,151 @@
+package server_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/server"
+)
+
+var errInUse = errors.New("address already in use")
+
+// Ports listened by pool owners and other processes
+type ports map[uint16]string
+
+// Listen function to owner, port bound by other owner or process fail
+func (bound ports) listen(owner string) func(port uint16) error {
+	return func(port uint16) error {
+		if current, ok := bound[port]; ok && current != owner {
+			return errInUse
+		}
+		bound[port] = owner
+		return nil
+	}
+}
+
+// Tunnel closed, listeners of owner are closed
+func (bound ports) close(owner string) {
+	for port, current := range bound {
+		if current == owner {
+			delete(bound, port)
+		}
+	}
+}
+
+func newPool(t *testing.T, first, last uint16) *server.PortPool {
+	pool, err := server.NewPortPool(first, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// Mapping get same port after agent reconnect, other mappings not get port while reserved
+func TestPortReuse(t *testing.T) {
+	pool, bound := newPool(t, 20000, 20010), ports{}
+	first, err := pool.Listen("agent/1", bound.listen("agent/1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound.close("agent/1")
+	pool.Detach("agent/1")
+
+	if other, err := pool.Listen("other/1", bound.listen("other/1")); err != nil {
+		t.Fatal(err)
+	} else if other == first {
+		t.Fatalf("port %d reserved to closed tunnel given to other", first)
+	} else if port, err := pool.Listen("agent/1", bound.listen("agent/1")); err != nil || port != first {
+		t.Fatalf("reconnect listen port %d, %v, reserved %d", port, err, first)
+	}
+}
+
+// Ports used by other process are skipped and reservation move to new port
+func TestPortInUse(t *testing.T) {
+	pool, bound := newPool(t, 20000, 20010), ports{20000: "process", 20001: "process"}
+	port, err := pool.Listen("agent/1", bound.listen("agent/1"))
+	if err != nil || port != 20002 {
+		t.Fatalf("listen port %d, %v, expected first free 20002", port, err)
+	}
+
+	bound.close("agent/1")
+	bound[20002] = "process" // Taken while tunnel offline
+	if port, err = pool.Listen("agent/1", bound.listen("agent/1")); err != nil || port == 20002 {
+		t.Fatalf("listen port %d, %v after reserved port taken", port, err)
+	} else if reserved, _ := pool.Port("agent/1"); reserved != port {
+		t.Fatalf("reservation %d not moved to %d", reserved, port)
+	}
+}
+
+func TestNoPorts(t *testing.T) {
+	pool, bound := newPool(t, 20000, 20002), ports{20001: "process"}
+	for _, owner := range []string{"agent/1", "agent/2"} {
+		if _, err := pool.Listen(owner, bound.listen(owner)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if port, err := pool.Listen("agent/3", bound.listen("agent/3")); err != server.ErrNoPorts {
+		t.Fatalf("listen in full pool return %d, %v", port, err)
+	}
+
+	bound.close("agent/1")
+	pool.Release("agent/1")
+	if _, err := pool.Listen("agent/3", bound.listen("agent/3")); err != nil {
+		t.Fatalf("listen after release: %v", err)
+	}
+}
+
+// Port of closed tunnel is released to other owners after TTL
+func TestPortExpire(t *testing.T) {
+	pool, bound := newPool(t, 20000, 20000), ports{}
+	pool.TTL = 20 * time.Millisecond
+	var released []string
+	pool.OnRelease = func(owner string) { released = append(released, owner) }
+
+	if _, err := pool.Listen("agent/1", bound.listen("agent/1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Listen("agent/2", bound.listen("agent/2")); err != server.ErrNoPorts {
+		t.Fatalf("listen port of running tunnel return %v", err)
+	}
+	bound.close("agent/1")
+	pool.Detach("agent/1")
+	if _, err := pool.Listen("agent/2", bound.listen("agent/2")); err != server.ErrNoPorts {
+		t.Fatalf("listen port before TTL return %v", err)
+	}
+
+	time.Sleep(2 * pool.TTL)
+	if port, err := pool.Listen("agent/2", bound.listen("agent/2")); err != nil || port != 20000 {
+		t.Fatalf("listen expired port return %d, %v", port, err)
+	} else if len(released) != 1 || released[0] != "agent/1" {
+		t.Fatalf("released %v", released)
+	} else if _, ok := pool.Port("agent/1"); ok {
+		t.Fatal("expired owner still reserved")
+	}
+}
+
+// Listen is called without pool lock, slow bind not block other mappings
+func TestListenUnlocked(t *testing.T) {
+	pool := newPool(t, 20000, 20010)
+	done := make(chan uint16, 1)
+	port, err := pool.Listen("agent/1", func(port uint16) error {
+		go func() {
+			other, _ := pool.Listen("agent/2", func(uint16) error { return nil })
+			done <- other
+		}()
+		select {
+		case other := <-done:
+			if other == port {
+				t.Errorf("port %d listened by two owners", port)
+			}
+		case <-time.After(time.Second):
+			t.Error("other listen blocked while bind")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if reserved, _ := pool.Port("agent/1"); reserved != port {
+		t.Fatalf("reservation %d, listened %d", reserved, port)
+	}
+}
@@ -1,17 +1,41 @@
 package server
 
 import (
+	"crypto/ecdh"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"runtime"
+	"time"
 
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/congestion"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pmtu"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/registry"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/secure"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/udplisterner"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
 )
 
 var (
-	ErrAuthAgentFail error = errors.New("cannot authenticate agent") // Send unathorized client and close new accepts from current port
+	ErrAuthAgentFail    error = errors.New("cannot authenticate agent") // Send unathorized client and close new accepts from current port
+	ErrInvalidTransport error = errors.New("invalid controller transport, use udp, tcp or tls")
+	ErrTLSConfig        error = errors.New("tls transport require certificate config")
+
+	HandshakeTimeout      time.Duration = time.Second * 15       // Time to agent start secure handshake
+	AuthTimeout           time.Duration = time.Second * 15       // Time to agent send hello and authenticate after connect or handshake
+	ResumeTimeout         time.Duration = time.Second * 30       // Time to agent reconnect and resume tunnel before close clients
+	AgentTimeout          time.Duration = time.Second * 30       // Default time without requests from agent before close tunnel
+	UDPIdleTimeout        time.Duration = time.Minute * 2        // Close UDP clients without datagrams in this time
+	FlushTimeout          time.Duration = time.Second * 10       // Time to agent acknowledge client data before close client
+	UDPMaxPeers           int           = 1024                   // Max UDP clients per tunnel, least recently used is closed
+	ControllerIdleTimeout time.Duration = time.Minute * 5        // Close UDP controller peers without datagrams in this time, must be bigger than agent timeouts
+	ControllerMaxPeers    int           = 4096                   // Max agents connected to UDP controller, least recently used is closed
+	ClientQueueSize       int           = 64                     // Datagrams queued to each UDP client before block agent requests
+	Version               string        = "devel"                // Controller version sent to agents in hello
+	StreamWindow          uint64        = proto.InitialWindow    // Bytes agent can send to TCP client before controller write to client
+	Congestion            string        = congestion.NameNewReno // Congestion controller to TCP client streams, newreno or bbr
 )
 
 type ServerCall interface {
@@ -19,32 +43,134 @@ type ServerCall interface {
 	AgentAuthentication(Token [36]byte) (TunnelInfo, error)
 }
 
+type ControllerConfig struct {
+	Transports []string         // Transports to listen: proto.TransportUDP, proto.TransportTCP or proto.TransportTLS, TCP and TLS cannot be used together
+	TLSConfig  *tls.Config      // Certificates to TLS transport
+	PrivateKey *ecdh.PrivateKey // Controller static key, if set agents require encrypted connection with public key pinned
+	PortPool   *PortPool        // Ports to mappings without port or with port in use
+}
+
 type Server struct {
-	ControllConn net.Listener
-	ProcessError chan error
-	ControlCalls ServerCall
-	Agents       map[string]*Tunnel
+	ControllConn   net.Listener // UDP controller listener
+	ControllStream net.Listener // TCP or TLS controller listener
+	ProcessError   chan error
+	ControlCalls   ServerCall
+	Config         ControllerConfig
+	Agents         *registry.Registry[string, *Tunnel] // Tunnels by agent token
 }
 
+// Create controller listening only UDP
 func NewController(calls ServerCall, local netip.AddrPort) (*Server, error) {
-	conn, err := udplisterner.ListenAddrPort("udp", local)
-	if err != nil {
-		return nil, err
-	}
+	return NewControllerConfig(calls, local, ControllerConfig{Transports: []string{proto.TransportUDP}})
+}
+
+// Create controller with listeners and encryption from config
+func NewControllerConfig(calls ServerCall, local netip.AddrPort, config ControllerConfig) (*Server, error) {
 	tuns := &Server{
-		ControllConn: conn,
 		ControlCalls: calls,
-		Agents:       make(map[string]*Tunnel),
+		Config:       config,
+		Agents:       registry.New[string, *Tunnel](),
 		ProcessError: make(chan error),
 	}
-	go tuns.handler()
+
+	var err error
+	for _, transport := range config.Transports {
+		switch transport {
+		case proto.TransportUDP:
+			if tuns.ControllConn != nil {
+				continue
+			} else if tuns.ControllConn, err = udplisterner.ListenConfig("udp", local, udplisterner.Config{
+				IdleTimeout:  ControllerIdleTimeout,
+				MaxPeers:     ControllerMaxPeers,
+				DontFragment: true,
+				Packet:       true,
+			}); err != nil {
+				tuns.Close()
+				return nil, err
+			}
+		case proto.TransportTCP, proto.TransportTLS:
+			if tuns.ControllStream != nil {
+				tuns.Close()
+				return nil, ErrInvalidTransport
+			} else if transport == proto.TransportTLS && config.TLSConfig == nil {
+				tuns.Close()
+				return nil, ErrTLSConfig
+			} else if tuns.ControllStream, err = net.ListenTCP("tcp", net.TCPAddrFromAddrPort(local)); err != nil {
+				tuns.Close()
+				return nil, err
+			} else if transport == proto.TransportTLS {
+				tuns.ControllStream = tls.NewListener(tuns.ControllStream, config.TLSConfig)
+			}
+		default:
+			tuns.Close()
+			return nil, ErrInvalidTransport
+		}
+	}
+	if tuns.ControllConn == nil && tuns.ControllStream == nil {
+		return nil, ErrInvalidTransport
+	}
+
+	if tuns.ControllConn != nil {
+		go tuns.handler(tuns.ControllConn)
+	}
+	if tuns.ControllStream != nil {
+		go tuns.handler(tuns.ControllStream)
+	}
 	return tuns, nil
 }
 
-func (controller *Server) handler() {
-	defer controller.ControllConn.Close()
+// Close controller listeners
+func (controller *Server) Close() error {
+	if controller.ControllConn != nil {
+		controller.ControllConn.Close()
+	}
+	if controller.ControllStream != nil {
+		controller.ControllStream.Close()
+	}
+	return nil
+}
+
+// Convert AgentAuthentication error to response, ServerCall can return *proto.Error to send custom code
+func authError(err error) *proto.Error {
+	var resErr *proto.Error
+	if errors.As(err, &resErr) {
+		return resErr
+	} else if err == ErrAuthAgentFail {
+		return &proto.Error{Code: proto.CodeUnauthorized, Message: "agent token rejected"}
+	}
+	return &proto.Error{Code: proto.CodeInternal, Message: err.Error()}
+}
+
+// Controller version and capabilities
+func (controller *Server) hello(version uint16, capabilities uint64) *proto.Hello {
+	return &proto.Hello{
+		Version:      version,
+		MinVersion:   proto.MinProtocolVersion,
+		Capabilities: capabilities,
+		Software:     Version,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+	}
+}
+
+// Negotiate agent hello, return agent hello with version and capabilities negotiated or nil if version is not supported
+func (controller *Server) negotiate(agent proto.Hello) *proto.Hello {
+	capabilities := proto.CapMappings | proto.CapResume | proto.CapFlowControl | proto.CapPathMTU | proto.CapNewClient
+	if controller.Config.PrivateKey != nil {
+		capabilities |= proto.CapEncryption
+	}
+	version, capabilities, ok := proto.Negotiate(agent, *controller.hello(proto.ProtocolVersion, capabilities))
+	if !ok {
+		return nil
+	}
+	agent.Version, agent.Capabilities = version, capabilities
+	return &agent
+}
+
+func (controller *Server) handler(ln net.Listener) {
+	defer ln.Close()
 	for {
-		conn, err := controller.ControllConn.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			break
 		}
@@ -53,38 +179,125 @@ func (controller *Server) handler() {
 }
 
 func (controller *Server) handlerConn(conn net.Conn) {
-	defer conn.Close() // End agent accepted
+	if controller.Config.PrivateKey != nil {
+		secureConn, err := secure.Server(conn, controller.Config.PrivateKey, HandshakeTimeout)
+		if err != nil {
+			conn.Close()
+			return // Reject agents without encryption
+		}
+		conn = secureConn
+	}
+	if pmtu.IsDatagram(conn) {
+		conn = newDatagramConn(conn) // Frames not continue in next datagram
+	}
+
 	var req *proto.Request
+	var token proto.AgentAuth
+	var hello *proto.Hello
 	var tunnelInfo TunnelInfo
 	var err error
+	conn.SetReadDeadline(time.Now().Add(AuthTimeout)) // Close peers that never authenticate
 	for {
 		if req, err = proto.ReaderRequest(conn); err != nil {
-			panic(err)
-			return
+			if skipFrame(conn, err) {
+				continue
+			}
+			conn.Close()
+			return // Agent disconnected before auth
 		}
 
-		if req.AgentAuth == nil {
-			proto.WriteResponse(conn, proto.Response{SendAuth: true})
+		if req.Hello != nil {
+			if hello = controller.negotiate(*req.Hello); hello == nil {
+				proto.WriteResponse(conn, proto.Response{ID: req.ID, Incompatible: &proto.Incompatible{
+					Version:    proto.ProtocolVersion,
+					MinVersion: proto.MinProtocolVersion,
+					Message:    fmt.Sprintf("agent protocol versions %d-%d, controller require %d-%d", req.Hello.MinVersion, req.Hello.Version, proto.MinProtocolVersion, proto.ProtocolVersion),
+				}})
+				conn.Close()
+				return
+			}
+			proto.WriteResponse(conn, proto.Response{ID: req.ID, Hello: controller.hello(hello.Version, hello.Capabilities)})
 			continue
-		} else if tunnelInfo, err = controller.ControlCalls.AgentAuthentication([36]byte(req.AgentAuth[:])); err != nil {
-			if err == ErrAuthAgentFail {
-				proto.WriteResponse(conn, proto.Response{Unauthorized: true})
+		} else if req.AgentShutdown != nil {
+			proto.WriteResponse(conn, proto.Response{ID: req.ID, ShutdownAck: true}) // Tunnel already closed
+			conn.Close()
+			return
+		} else if (req.Resume != nil || req.AgentAuth != nil) && hello == nil {
+			proto.WriteResponse(conn, proto.Response{ID: req.ID, Incompatible: &proto.Incompatible{
+				Version:    proto.ProtocolVersion,
+				MinVersion: proto.MinProtocolVersion,
+				Message:    "agent not sent hello, update agent",
+			}})
+			conn.Close()
+			return
+		} else if req.Resume != nil {
+			token = req.Resume.Token
+		} else if req.AgentAuth != nil {
+			token = *req.AgentAuth
+		} else {
+			proto.WriteResponse(conn, proto.Response{ID: req.ID, SendAuth: true})
+			continue
+		}
+
+		if tunnelInfo, err = controller.ControlCalls.AgentAuthentication([36]byte(token[:])); err != nil {
+			resErr := *authError(err) // Copy, ServerCall error can be shared
+			resErr.RequestID = req.ID
+			proto.WriteResponse(conn, proto.Response{ID: req.ID, Error: resErr.For(hello.Version)})
+			if resErr.Code == proto.CodeUnauthorized {
+				conn.Close()
 				return
 			}
-			proto.WriteResponse(conn, proto.Response{BadRequest: true})
 			continue
 		}
 		break
 	}
+	conn.SetReadDeadline(time.Time{}) // Tunnel check agent timeout
 
-	// Close current tunnel
-	if tun, ok := controller.Agents[string(req.AgentAuth[:])]; ok {
+	if tun, ok := controller.Agents.Load(string(token[:])); ok {
+		// Move tunnel to new connection, tunnel close conn
+		if req.Resume != nil && req.Resume.Session == tun.SessionID && tun.Resume(conn, req.ID) {
+			return
+		}
+
+		// Close current tunnel
 		fmt.Println("closing old tunnel")
-		tun.Close() // Close connection
+		tun.Shutdown(ShutdownReplaced) // Close connection
 	}
 
-	var tun = &Tunnel{RootConn: conn, TunInfo: tunnelInfo, UDPClients: make(map[string]net.Conn), TCPClients: make(map[string]net.Conn)}
-	controller.Agents[string(req.AgentAuth[:])] = tun
+	tun := NewTunnel(conn, tunnelInfo)
+	tun.Token, tun.Ports, tun.Agent, tun.authID = token, controller.Config.PortPool, *hello, req.ID
+	controller.Agents.Store(string(token[:]), tun)
 	tun.Setup()
-	delete(controller.Agents, string(req.AgentAuth[:]))
+	tun.Shutdown(ShutdownDisconnected) // Setup cannot listen
+	controller.Agents.CompareAndDelete(string(token[:]), tun)
+}
+
+// Agent UDP connection, each Read of raw connection is one datagram with complete frames
+type datagramConn struct {
+	net.Conn
+	reader *proto.DatagramReader
+}
+
+func newDatagramConn(conn net.Conn) *datagramConn {
+	return &datagramConn{Conn: conn, reader: proto.NewDatagramReader(conn)}
+}
+
+func (conn *datagramConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// Drop rest of current datagram, next frame start in next datagram
+func (conn *datagramConn) drop() {
+	conn.reader.Reset(conn.Conn)
+}
+
+// Check if reader can continue after frame error, datagram connections drop rest of datagram
+func skipFrame(conn net.Conn, err error) bool {
+	if proto.IsFrameSkippable(err) {
+		return true
+	} else if datagram, ok := conn.(*datagramConn); ok && (errors.Is(err, proto.ErrFrameMagic) || errors.Is(err, proto.ErrFrameTruncated) || errors.Is(err, proto.ErrFrameOversized)) {
+		datagram.drop()
+		return true
+	}
+	return false
 }
@@ -1,12 +1,28 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/congestion"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/flow"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/fragment"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pipe"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/pmtu"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/queue"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/registry"
+	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/reliable"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/internal/udplisterner"
 	"sirherobrine23.org/Minecraft-Server/go-pproxit/proto"
 )
@@ -14,198 +30,640 @@ import (
 type TunnelCall interface {
 	BlockedAddr(AddrPort string) bool                        // Ignore request from this address
 	AgentPing(agent, server time.Time)                       // Register ping to Agent
-	AgentShutdown(onTime time.Time)                          // Agend end connection
+	AgentShutdown(onTime time.Time, reason string)           // Agend end connection
 	RegisterRX(client netip.AddrPort, Size int, Proto uint8) // Register Recived data from client
 	RegisterTX(client netip.AddrPort, Size int, Proto uint8) // Register Transmitted data from client
+	DialFailed(client proto.Client, reason string)           // Agent cannot dial target to client
 }
 
+const (
+	ShutdownAgent        string = "agent shutdown"     // Agent sent shutdown request
+	ShutdownDisconnected string = "agent disconnected" // Agent connection closed or broken
+	ShutdownReplaced     string = "agent reconnected"  // New agent connection with same token
+	ShutdownClosed       string = "tunnel closed"      // Tunnel closed by controller
+	ShutdownTimeout      string = "agent timeout"      // Agent not sent requests or ping in timeout
+)
+
 type TunnelInfo struct {
-	Proto            uint8      // Protocol listen tunnel, use proto.ProtoTCP, proto.ProtoUDP or proto.ProtoBoth
-	UDPPort, TCPPort uint16     // Port to Listen UDP and TCP listeners
-	Callbacks        TunnelCall // Tunnel Callbacks
+	Mappings     []proto.Mapping // Ports to listen and agent target name, Proto is proto.ProtoTCP, proto.ProtoUDP or proto.ProtoBoth
+	AgentTimeout time.Duration   // Close tunnel if agent not send requests in this time, zero use AgentTimeout
+	Callbacks    TunnelCall      // Tunnel Callbacks
+}
+
+// Agent connection and resume request ID
+type resumeConn struct {
+	conn net.Conn
+	id   uint32
 }
 
 type Tunnel struct {
-	RootConn net.Conn   // Current client connection
-	TunInfo  TunnelInfo // Tunnel info
+	RootConn  net.Conn        // Current client connection
+	TunInfo   TunnelInfo      // Tunnel info
+	SessionID proto.SessionID // Session agent send to resume tunnel
+	Token     proto.AgentAuth // Agent token, owner of ports in pool
+	Ports     *PortPool       // Pool to mappings without port or port in use, nil to listen only mapping port
+	Agent     proto.Hello     // Agent hello with version and capabilities negotiated
+
+	connMu sync.RWMutex    // Guard RootConn swap on resume
+	resume chan resumeConn // New agent connection to resume session
+	closed chan struct{}   // Closed on shutdown
+	authID uint32          // Auth request ID answered by first AgentInfo
 
-	connTCP *net.TCPListener
-	connUDP net.Listener
+	connTCP []*net.TCPListener // TCP listeners of mappings
+	connUDP []net.Listener     // UDP listeners of mappings
 
-	UDPClients map[string]net.Conn // Current clients connected
-	TCPClients map[string]net.Conn // Current clients connected
+	UDPClients *registry.Registry[string, net.Conn] // Current clients connected
+	TCPClients *registry.Registry[string, net.Conn] // Current clients connected
+
+	tcpStreams  *registry.Registry[string, *reliable.Stream] // Sequence and retransmit TCP clients data
+	sendWindows *registry.Registry[string, *flow.Send]       // Credit to send data to TCP clients
+	recvWindows *registry.Registry[string, *flow.Recv]       // Data consumed from TCP clients
+	halfClosed  *registry.Registry[string, bool]             // TCP clients with one direction closed
+	closeOnce   sync.Once
+
+	datagram  atomic.Uint32         // Datagram size to agent connection, updated by agent path MTU discovery
+	fragID    atomic.Uint32         // Last fragment ID sent
+	fragments *fragment.Reassembler // Fragments from agent waiting reassembly
+}
+
+// Create tunnel to agent connection with new session
+func NewTunnel(conn net.Conn, info TunnelInfo) *Tunnel {
+	info.Mappings = slices.Clone(info.Mappings) // Ports updated after listen
+	tun := &Tunnel{
+		RootConn:    conn,
+		TunInfo:     info,
+		resume:      make(chan resumeConn),
+		closed:      make(chan struct{}),
+		UDPClients:  registry.New[string, net.Conn](),
+		TCPClients:  registry.New[string, net.Conn](),
+		tcpStreams:  registry.New[string, *reliable.Stream](),
+		sendWindows: registry.New[string, *flow.Send](),
+		recvWindows: registry.New[string, *flow.Recv](),
+		halfClosed:  registry.New[string, bool](),
+		fragments:   fragment.NewReassembler(),
+	}
+	tun.datagram.Store(uint32(pmtu.Initial(conn)))
+	rand.Read(tun.SessionID[:])
+	return tun
 }
 
 func (tun *Tunnel) Close() error {
-	tun.connTCP.Close()
-	tun.connUDP.Close()
+	return tun.Shutdown(ShutdownClosed)
+}
+
+// Close listeners and clients and register shutdown with reason
+func (tun *Tunnel) Shutdown(reason string) error {
+	tun.closeOnce.Do(func() { tun.shutdown(reason) })
+	return nil
+}
+
+func (tun *Tunnel) shutdown(reason string) {
+	close(tun.closed)
+	for _, ln := range tun.connTCP {
+		ln.Close()
+	}
+	for _, ln := range tun.connUDP {
+		ln.Close()
+	}
+	if tun.Ports != nil {
+		for _, mapping := range tun.TunInfo.Mappings {
+			tun.Ports.Detach(PortOwner(tun.Token, mapping.ID)) // Agent reconnect in TTL get same port
+		}
+	}
 
 	// Stop TCP Clients
-	for k := range tun.TCPClients {
-		tun.TCPClients[k].Close()
-		delete(tun.TCPClients, k)
+	for _, stream := range tun.tcpStreams.Drain() {
+		stream.Close()
+	}
+	for _, window := range tun.sendWindows.Drain() {
+		window.Close()
+	}
+	tun.recvWindows.Drain()
+	tun.halfClosed.Drain()
+	for _, cl := range tun.TCPClients.Drain() {
+		cl.Close()
 	}
 
 	// Stop UDP Clients
-	for k := range tun.UDPClients {
-		tun.UDPClients[k].Close()
-		delete(tun.UDPClients, k)
+	for _, cl := range tun.UDPClients.Drain() {
+		cl.Close()
 	}
 
-	go tun.RootConn.Close()                            // End root conenction
-	go tun.TunInfo.Callbacks.AgentShutdown(time.Now()) // Register shutdown
-	return nil
+	go tun.conn().Close()                                      // End root conenction
+	go tun.TunInfo.Callbacks.AgentShutdown(time.Now(), reason) // Register shutdown
+}
+
+// Resume tunnel session in new agent connection, old connection is closed.
+// id is resume request ID answered with AgentInfo, return false if tunnel is closed
+func (tun *Tunnel) Resume(conn net.Conn, id uint32) bool {
+	tun.conn().Close() // Stop read requests from old connection
+	select {
+	case tun.resume <- resumeConn{conn, id}:
+		return true
+	case <-tun.closed:
+		return false
+	}
+}
+
+func (tun *Tunnel) conn() net.Conn {
+	tun.connMu.RLock()
+	defer tun.connMu.RUnlock()
+	return tun.RootConn
 }
 
 func (tun *Tunnel) send(res proto.Response) error {
-	return proto.WriteResponse(tun.RootConn, res)
+	return proto.WriteResponse(tun.conn(), res)
 }
 
-type toWr struct {
-	Proto uint8
-	To    netip.AddrPort
-	tun   *Tunnel
-}
-
-func (t toWr) Write(w []byte) (int, error) {
-	go t.tun.TunInfo.Callbacks.RegisterRX(t.To, len(w), t.Proto)
-	err := t.tun.send(proto.Response{
-		DataRX: &proto.ClientData{
-			Client: proto.Client{
-				Proto:  t.Proto,
-				Client: t.To,
-			},
-			Size: uint64(len(w)),
-			Data: w[:],
+// Send agent info in reply to auth or resume request
+func (tun *Tunnel) sendAgentInfo(id uint32) error {
+	return tun.send(proto.Response{
+		ID: id,
+		AgentInfo: &proto.AgentInfo{
+			AddrPort:  netip.MustParseAddrPort(tun.conn().RemoteAddr().String()),
+			SessionID: tun.SessionID,
+			Mappings:  tun.TunInfo.Mappings,
 		},
 	})
-	if err == nil {
+}
+
+// Datagram size to agent connection
+func (tun *Tunnel) DatagramSize() uint16 {
+	return uint16(tun.datagram.Load())
+}
+
+// Max data in one ClientData without fragment
+func (tun *Tunnel) dataSize() int {
+	return int(tun.DatagramSize() - proto.DataOverhead)
+}
+
+// Send data to agent, data bigger than datagram size is fragmented
+func (tun *Tunnel) sendData(To proto.Client, Seq uint64, w []byte) error {
+	fragments, err := fragment.Split(proto.ClientData{Client: To, Seq: Seq, Size: uint64(len(w)), Data: w}, tun.dataSize(), tun.fragID.Add(1))
+	if err != nil {
+		return err
+	}
+	for index := range fragments {
+		if err := tun.send(proto.Response{DataRX: &fragments[index]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type toWr struct {
+	To     proto.Client
+	tun    *Tunnel
+	stream *reliable.Stream // Sequence data to TCP clients
+	window *flow.Send       // Credit to send data to TCP clients
+}
+
+// Split stream data in chunks fit in datagram and send to other side, UDP datagram is sent complete
+func (t toWr) Write(w []byte) (n int, err error) {
+	go t.tun.TunInfo.Callbacks.RegisterRX(t.To.Client, len(w), t.To.Proto)
+	if t.stream == nil {
+		if err = t.tun.sendData(t.To, 0, w); err != nil && t.tun.isClosed() {
+			return 0, err // Datagrams sent while agent reconnect are lost
+		}
 		return len(w), nil
 	}
-	return 0, err
+	for len(w) > 0 {
+		chunk := w[:min(len(w), t.tun.dataSize())]
+		if t.window != nil {
+			var size int
+			if size, err = t.window.Acquire(len(chunk)); err != nil {
+				return // Block until agent consume data
+			}
+			chunk = chunk[:size]
+		}
+		if _, err = t.stream.Write(chunk); err != nil {
+			return
+		}
+		n += len(chunk)
+		w = w[len(chunk):]
+	}
+	return
+}
+
+func (tun *Tunnel) GetTargetWrite(To proto.Client) io.Writer {
+	wr := &toWr{To: To, tun: tun}
+	if To.Proto == proto.ProtoTCP {
+		wr.stream, _ = tun.tcpStreams.Load(To.Key())
+		wr.window, _ = tun.sendWindows.Load(To.Key())
+	}
+	return wr
+}
+
+// Bytes queued to TCP client, fit full stream window so agent requests not block
+// whatever the segment size, window is consumed after queue write data to client
+func streamQueueBytes() int {
+	return int(max(StreamWindow, proto.InitialWindow))
+}
+
+// Create reliable stream to TCP client
+func (tun *Tunnel) newStream(cl net.Conn, To proto.Client) *reliable.Stream {
+	cc, err := congestion.New(Congestion, reliable.Window)
+	if err != nil {
+		cc = congestion.NewNewReno(reliable.Window)
+	}
+	return reliable.NewStreamCongestion(cc, func(seq uint64, data []byte) error {
+		return tun.sendData(To, seq, data)
+	}, func(ack uint64) error {
+		return tun.send(proto.Response{DataAck: &proto.ClientAck{Client: To, Ack: ack}})
+	}, func(data []byte) error {
+		_, err := cl.Write(data)
+		return err
+	})
+}
+
+// Congestion control state of TCP client streams, key is client key
+func (tun *Tunnel) CongestionStats() map[string]congestion.Stats {
+	stats := make(map[string]congestion.Stats)
+	tun.tcpStreams.Range(func(key string, stream *reliable.Stream) bool {
+		stats[key] = stream.Congestion()
+		return true
+	})
+	return stats
+}
+
+// Write queue stats of clients, key is protocol and client key
+func (tun *Tunnel) QueueStats() map[string]queue.Stats {
+	stats := make(map[string]queue.Stats)
+	tun.TCPClients.Range(func(key string, cl net.Conn) bool {
+		if cl, ok := cl.(*queue.Conn); ok {
+			stats["tcp/"+key] = cl.Stats()
+		}
+		return true
+	})
+	tun.UDPClients.Range(func(key string, cl net.Conn) bool {
+		if cl, ok := cl.(*queue.Conn); ok {
+			stats["udp/"+key] = cl.Stats()
+		}
+		return true
+	})
+	return stats
 }
 
-func (tun *Tunnel) GetTargetWrite(Proto uint8, To netip.AddrPort) io.Writer {
-	return &toWr{Proto: Proto, To: To, tun: tun}
+func (tun *Tunnel) isClosed() bool {
+	select {
+	case <-tun.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 // Setup connections and maneger connections from agent
 func (tun *Tunnel) Setup() {
-	if proto.ProtoBoth == tun.TunInfo.Proto || proto.ProtoTCP == tun.TunInfo.Proto {
-		// Setup TCP Listerner
-		if err := tun.TCP(); err != nil {
-			tun.send(proto.Response{NotListened: true})
+	for index := range tun.TunInfo.Mappings {
+		if err := tun.listen(&tun.TunInfo.Mappings[index]); err != nil {
+			resErr := listenError(tun.TunInfo.Mappings[index], err)
+			resErr.RequestID = tun.authID
+			tun.send(proto.Response{ID: tun.authID, Error: resErr.For(tun.Agent.Version)})
 			return
 		}
 	}
-	if proto.ProtoBoth == tun.TunInfo.Proto || proto.ProtoUDP == tun.TunInfo.Proto {
-		// Setup UDP Listerner
-		if err := tun.UDP(); err != nil {
-			tun.send(proto.Response{NotListened: true})
+
+	reason := ShutdownDisconnected
+	defer func() { tun.Shutdown(reason) }()
+	tun.sendAgentInfo(tun.authID)
+	for {
+		var resumable bool
+		if reason, resumable = tun.serve(); !resumable {
 			return
 		}
-	}
 
-	defer tun.Close()
-	tun.send(proto.Response{
-		AgentInfo: &proto.AgentInfo{
-			Protocol: tun.TunInfo.Proto,
-			AddrPort: netip.MustParseAddrPort(tun.RootConn.RemoteAddr().String()),
-			UDPPort:  tun.TunInfo.UDPPort,
-			TCPPort:  tun.TunInfo.TCPPort,
-		},
-	})
+		// Wait agent reconnect with session
+		select {
+		case resume := <-tun.resume:
+			tun.connMu.Lock()
+			tun.RootConn = resume.conn
+			tun.datagram.Store(uint32(pmtu.Initial(resume.conn))) // Agent discover path MTU again
+			tun.connMu.Unlock()
+			tun.sendAgentInfo(resume.id) // Agent wait info before data
+			tun.tcpStreams.Range(func(_ string, stream *reliable.Stream) bool {
+				stream.Resume()
+				return true
+			})
+		case <-time.After(ResumeTimeout):
+			return
+		case <-tun.closed:
+			return
+		}
+	}
+}
 
+// Process requests from current agent connection, return shutdown reason and if agent can resume session
+func (tun *Tunnel) serve() (string, bool) {
+	conn, timeout := tun.conn(), tun.TunInfo.AgentTimeout
+	if timeout <= 0 {
+		timeout = AgentTimeout
+	}
 	for {
-		log.Printf("waiting request from %s", tun.RootConn.RemoteAddr().String())
-		req, err := proto.ReaderRequest(tun.RootConn)
+		log.Printf("waiting request from %s", conn.RemoteAddr().String())
+		conn.SetReadDeadline(time.Now().Add(timeout)) // Agent ping before timeout
+		req, err := proto.ReaderRequest(conn)
 		if err != nil {
-			return
+			if skipFrame(conn, err) {
+				continue
+			} else if opt, isOpt := err.(net.Error); isOpt && opt.Timeout() {
+				return ShutdownTimeout, false // Agent is dead, release ports
+			}
+			return ShutdownDisconnected, true
 		}
 
-		if req.AgentAuth != nil {
-			go tun.send(proto.Response{
-				AgentInfo: &proto.AgentInfo{
-					Protocol: tun.TunInfo.Proto,
-					AddrPort: netip.MustParseAddrPort(tun.RootConn.RemoteAddr().String()),
-					UDPPort:  tun.TunInfo.UDPPort,
-					TCPPort:  tun.TunInfo.TCPPort,
-				},
-			})
+		if req.AgentAuth != nil || req.Resume != nil {
+			go tun.sendAgentInfo(req.ID) // Agent not recived info
 			continue
+		} else if shutdown := req.AgentShutdown; req.AgentShutdown != nil {
+			tun.send(proto.Response{ID: req.ID, ShutdownAck: true})
+			if shutdown.Reason != "" {
+				return ShutdownAgent + ": " + shutdown.Reason, false
+			}
+			return ShutdownAgent, false
 		} else if ping := req.Ping; req.Ping != nil {
 			var now = time.Now()
-			tun.send(proto.Response{Pong: &now})
+			tun.send(proto.Response{ID: req.ID, Pong: &now})
 			go tun.TunInfo.Callbacks.AgentPing(*ping, now) // backgroud process
 		} else if clClose := req.ClientClose; req.ClientClose != nil {
-			if clClose.Proto == proto.ProtoTCP {
-				if cl, ok := tun.TCPClients[clClose.Client.String()]; ok {
-					cl.Close()
-				}
-			} else if clClose.Proto == proto.ProtoUDP {
-				if cl, ok := tun.UDPClients[clClose.Client.String()]; ok {
+			if clClose.Reason != "" {
+				go tun.TunInfo.Callbacks.DialFailed(clClose.Client, clClose.Reason)
+			}
+			if client := clClose.Client; client.Proto == proto.ProtoTCP {
+				tun.peerCloseTCP(client, clClose.Kind)
+			} else if client.Proto == proto.ProtoUDP {
+				tun.fragments.Delete(client)
+				if cl, ok := tun.UDPClients.LoadAndDelete(client.Key()); ok {
 					cl.Close()
 				}
 			}
 		} else if data := req.DataTX; req.DataTX != nil {
+			if data = tun.fragments.Add(data); data == nil {
+				continue // Wait all fragments
+			}
 			go tun.TunInfo.Callbacks.RegisterTX(data.Client.Client, int(data.Size), data.Client.Proto)
 			if data.Client.Proto == proto.ProtoTCP {
-				if cl, ok := tun.TCPClients[data.Client.Client.String()]; ok {
-					go cl.Write(data.Data) // Process in backgroud
+				if stream, ok := tun.tcpStreams.Load(data.Client.Key()); ok {
+					stream.Receive(data.Seq, data.Data) // Stream deliver in order to client queue
 				}
 			} else if data.Client.Proto == proto.ProtoUDP {
-				if cl, ok := tun.UDPClients[data.Client.Client.String()]; ok {
-					go cl.Write(data.Data) // Process in backgroud
+				if cl, ok := tun.UDPClients.Load(data.Client.Key()); ok {
+					cl.Write(data.Data) // Block if client queue is full
+				}
+			}
+		} else if update := req.WindowUpdate; req.WindowUpdate != nil {
+			if update.Probe {
+				if window, ok := tun.recvWindows.Load(update.Client.Key()); ok {
+					window.Advertise() // Agent lost last update
+				}
+			} else if window, ok := tun.sendWindows.Load(update.Client.Key()); ok {
+				window.Update(update.Limit)
+			}
+		} else if ack := req.DataAck; req.DataAck != nil {
+			if ack.Client.Proto == proto.ProtoTCP {
+				if stream, ok := tun.tcpStreams.Load(ack.Client.Key()); ok {
+					stream.Ack(ack.Ack)
 				}
 			}
+		} else if mtu := req.PathMTU; req.PathMTU != nil {
+			if mtu.Probe {
+				tun.send(proto.Response{ID: req.ID, PathMTU: mtu}) // Echo with same padding
+			} else if pmtu.IsDatagram(conn) {
+				tun.datagram.Store(uint32(mtu.Size))
+			}
 		}
 	}
 }
 
-// Listen TCP
-func (tun *Tunnel) TCP() (err error) {
-	if tun.connTCP, err = net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.IPv4Unspecified(), tun.TunInfo.TCPPort))); err != nil {
+// Convert listen error to response with reason mapping cannot listen
+func listenError(mapping proto.Mapping, err error) *proto.Error {
+	resErr := &proto.Error{Code: proto.CodeListen, Message: fmt.Sprintf("mapping %d %q port %d: %s", mapping.ID, mapping.Name, mapping.Port, err)}
+	if errors.Is(err, ErrNoPorts) {
+		resErr.Code = proto.CodePortQuota
+	} else if errors.Is(err, syscall.EADDRINUSE) {
+		resErr.Code = proto.CodePortInUse
+	} else if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) {
+		resErr.Code = proto.CodePortDisabled
+	}
+	return resErr
+}
+
+const listenAttempts = 8 // Tries to find port system assign free to TCP and UDP
+
+// Listen mapping port, mapping without port or port in use get port from pool
+func (tun *Tunnel) listen(mapping *proto.Mapping) error {
+	if tun.Ports == nil || mapping.Port != 0 {
+		err := tun.listenPort(mapping)
+		for attempt := 1; err != nil && mapping.Port == 0 && mapping.Proto == proto.ProtoBoth && attempt < listenAttempts; attempt++ {
+			err = tun.listenPort(mapping) // Port assigned to TCP is used by other UDP socket, try new port
+		}
+		if err == nil || tun.Ports == nil {
+			return err
+		}
+	}
+	port, err := tun.Ports.Listen(PortOwner(tun.Token, mapping.ID), func(port uint16) error {
+		listen := *mapping
+		listen.Port = port
+		return tun.listenPort(&listen)
+	})
+	if err != nil {
 		return err
 	}
+	mapping.Port = port // Report port listened to agent
+	return nil
+}
+
+// Listen mapping protocols in same port, if port is zero mapping.Port is set to port assigned by system
+func (tun *Tunnel) listenPort(mapping *proto.Mapping) error {
+	listen := *mapping
+	if proto.ProtoBoth == listen.Proto || proto.ProtoTCP == listen.Proto {
+		// Setup TCP Listerner
+		if err := tun.TCP(listen); err != nil {
+			return err
+		}
+		listen.Port = listenedPort(tun.connTCP[len(tun.connTCP)-1].Addr()) // UDP listen same port
+	}
+	if proto.ProtoBoth == listen.Proto || proto.ProtoUDP == listen.Proto {
+		// Setup UDP Listerner
+		if err := tun.UDP(listen); err != nil {
+			if proto.ProtoBoth == listen.Proto {
+				last := len(tun.connTCP) - 1
+				tun.connTCP[last].Close() // Port is not free to both protocols
+				tun.connTCP = tun.connTCP[:last]
+			}
+			return err
+		}
+		listen.Port = listenedPort(tun.connUDP[len(tun.connUDP)-1].Addr())
+	}
+	mapping.Port = listen.Port
+	return nil
+}
+
+// Port of listener address
+func listenedPort(addr net.Addr) uint16 {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return uint16(addr.Port)
+	case *net.UDPAddr:
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+// Listen TCP port of mapping
+func (tun *Tunnel) TCP(mapping proto.Mapping) error {
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.IPv4Unspecified(), mapping.Port)))
+	if err != nil {
+		return err
+	}
+	tun.connTCP = append(tun.connTCP, ln)
 	go func() {
 		for {
-			conn, err := tun.connTCP.AcceptTCP()
+			conn, err := ln.AcceptTCP()
 			if err != nil {
 				// panic(err) // TODO: fix accepts in future
 				return
 			}
-			remote := netip.MustParseAddrPort(conn.RemoteAddr().String())
-			if tun.TunInfo.Callbacks.BlockedAddr(remote.Addr().String()) {
+			remote := proto.Client{Client: netip.MustParseAddrPort(conn.RemoteAddr().String()), Proto: proto.ProtoTCP, Mapping: mapping.ID}
+			if tun.TunInfo.Callbacks.BlockedAddr(remote.Client.Addr().String()) {
 				conn.Close() // Close connection
 				continue
 			}
-			tun.TCPClients[remote.String()] = conn
-			go io.Copy(tun.GetTargetWrite(proto.ProtoTCP, remote), conn)
+			tun.sendWindows.Store(remote.Key(), flow.NewSend(proto.InitialWindow, func(limit uint64) error {
+				return tun.send(proto.Response{WindowUpdate: &proto.WindowUpdate{Client: remote, Limit: limit, Probe: true}})
+			}))
+			window := flow.NewRecv(proto.InitialWindow, StreamWindow, func(limit uint64) error {
+				return tun.send(proto.Response{WindowUpdate: &proto.WindowUpdate{Client: remote, Limit: limit}})
+			})
+			tun.recvWindows.Store(remote.Key(), window)
+			cl := queue.NewConnBytes(conn, streamQueueBytes(), window.Consume)
+			tun.TCPClients.Store(remote.Key(), cl)
+			tun.tcpStreams.Store(remote.Key(), tun.newStream(cl, remote))
+			tun.announce(remote)
+			go func() {
+				_, err := io.Copy(tun.GetTargetWrite(remote), conn)
+				tun.localCloseTCP(remote, cl, err)
+			}()
 		}
 	}()
 	return nil
 }
 
-// Listen UDP
-func (tun *Tunnel) UDP() (err error) {
-	if tun.connUDP, err = udplisterner.ListenAddrPort("udp", netip.AddrPortFrom(netip.IPv4Unspecified(), tun.TunInfo.UDPPort)); err != nil {
+// Notify agent of accepted client so agent dial target before client send data
+func (tun *Tunnel) announce(client proto.Client) {
+	if tun.Agent.Has(proto.CapNewClient) {
+		tun.send(proto.Response{NewClient: &client})
+	}
+}
+
+// Client stop send data, send close to agent after agent acknowledge data sent before
+func (tun *Tunnel) localCloseTCP(client proto.Client, cl net.Conn, err error) {
+	if current, ok := tun.TCPClients.Load(client.Key()); !ok || current != cl {
+		return // Closed by agent
+	}
+	kind := proto.CloseFull
+	if pipe.IsReset(err) {
+		kind = proto.CloseAbort
+	} else if err == nil {
+		kind = proto.CloseWrite
+		if stream, ok := tun.tcpStreams.Load(client.Key()); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
+			stream.Flush(ctx)
+			cancel()
+		}
+	}
+	close := proto.ClientClose{Client: client, Kind: kind}.For(tun.Agent.Version) // Old agents close full connection
+	tun.send(proto.Response{CloseClient: &close})
+	if close.Kind == proto.CloseWrite && !tun.halfClose(client) {
+		return // Agent still send data to client
+	}
+	if cl, ok := tun.releaseTCP(client); ok {
+		cl.Close()
+	}
+}
+
+// Agent closed TCP client, shutdown write, close or reset client connection
+func (tun *Tunnel) peerCloseTCP(client proto.Client, kind uint8) {
+	if kind == proto.CloseWrite && !tun.halfClose(client) {
+		if cl, ok := tun.TCPClients.Load(client.Key()); ok {
+			pipe.CloseWrite(cl) // Client still send data to agent
+		}
 		return
 	}
+	cl, ok := tun.releaseTCP(client)
+	if !ok {
+		return
+	} else if kind == proto.CloseAbort {
+		pipe.Abort(cl) // Target refused or reset, client see connection reset
+		return
+	}
+	cl.Close()
+}
+
+// One direction of TCP client closed, true if other direction closed before
+func (tun *Tunnel) halfClose(client proto.Client) bool {
+	_, closed := tun.halfClosed.LoadOrStore(client.Key(), true)
+	return closed
+}
+
+// Remove TCP client state, return client connection if not removed before
+func (tun *Tunnel) releaseTCP(client proto.Client) (net.Conn, bool) {
+	if stream, ok := tun.tcpStreams.LoadAndDelete(client.Key()); ok {
+		stream.Close()
+	}
+	if window, ok := tun.sendWindows.LoadAndDelete(client.Key()); ok {
+		window.Close()
+	}
+	tun.recvWindows.Delete(client.Key())
+	tun.halfClosed.Delete(client.Key())
+	tun.fragments.Delete(client)
+	return tun.TCPClients.LoadAndDelete(client.Key())
+}
+
+// UDP client idle or evicted, notify agent to close client
+func (tun *Tunnel) expireUDP(client proto.Client) {
+	if cl, ok := tun.UDPClients.LoadAndDelete(client.Key()); ok {
+		cl.Close() // Stop queue writer
+	}
+	tun.fragments.Delete(client)
+	tun.send(proto.Response{CloseClient: &proto.ClientClose{Client: client}})
+}
+
+// Listen UDP port of mapping
+func (tun *Tunnel) UDP(mapping proto.Mapping) error {
+	ln, err := udplisterner.ListenConfig("udp", netip.AddrPortFrom(netip.IPv4Unspecified(), mapping.Port), udplisterner.Config{
+		IdleTimeout: UDPIdleTimeout,
+		MaxPeers:    UDPMaxPeers,
+		Packet:      true, // Games need datagram boundaries
+		OnExpire: func(client netip.AddrPort) {
+			tun.expireUDP(proto.Client{Client: client, Proto: proto.ProtoUDP, Mapping: mapping.ID})
+		},
+	})
+	if err != nil {
+		return err
+	}
+	tun.connUDP = append(tun.connUDP, ln)
 	go func() {
 		for {
-			conn, err := tun.connUDP.Accept()
+			conn, err := ln.Accept()
 			if err != nil {
 				// panic(err) // TODO: fix accepts in future
 				return
 			}
-			remote := netip.MustParseAddrPort(conn.RemoteAddr().String())
-			if tun.TunInfo.Callbacks.BlockedAddr(remote.Addr().String()) {
+			remote := proto.Client{Client: netip.MustParseAddrPort(conn.RemoteAddr().String()), Proto: proto.ProtoUDP, Mapping: mapping.ID}
+			if tun.TunInfo.Callbacks.BlockedAddr(remote.Client.Addr().String()) {
 				conn.Close() // Close connection
 				continue
 			}
-			tun.UDPClients[remote.String()] = conn
-			go io.Copy(tun.GetTargetWrite(proto.ProtoUDP, remote), conn)
+			cl := queue.NewConn(conn, ClientQueueSize)
+			tun.UDPClients.Store(remote.Key(), cl)
+			tun.announce(remote)
+			go func() {
+				io.CopyBuffer(tun.GetTargetWrite(remote), conn, make([]byte, proto.MaxDataSize)) // Read full datagram
+				tun.UDPClients.CompareAndDelete(remote.Key(), cl)
+				cl.Close() // Stop queue writer
+			}()
 		}
 	}()
-	return
+	return nil
 }